@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	maxCaptionRunes    = 200
+	minCaptionFontSize = 8
+	maxCaptionFontSize = 72
+)
+
+// Caption is the meme style text drawn at the top and bottom of every frame.
+type Caption struct {
+	Top    string
+	Bottom string
+}
+
+func (c Caption) Empty() bool {
+	return c.Top == "" && c.Bottom == ""
+}
+
+var (
+	captionFont = sync.OnceValues(func() (*opentype.Font, error) {
+		return opentype.Parse(gobold.TTF)
+	})
+
+	// customEmojiPattern matches Discord custom emoji like <:name:123> and <a:name:123>.
+	customEmojiPattern = regexp.MustCompile(`<a?:(\w+):\d+>`)
+)
+
+func captionFace(size float64) (font.Face, error) {
+	f, err := captionFont()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse caption font: %w", err)
+	}
+
+	return opentype.NewFace(f, &opentype.FaceOptions{
+		Size:    size,
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+}
+
+// cleanCaption turns custom emoji into their :name:, drops characters the
+// font has no glyph for (regular emoji included) and collapses whitespace.
+func cleanCaption(text string, face font.Face) string {
+	text = customEmojiPattern.ReplaceAllString(text, ":$1:")
+
+	var b strings.Builder
+	count := 0
+
+	for _, r := range text {
+		if count == maxCaptionRunes {
+			break
+		}
+
+		if unicode.IsSpace(r) {
+			b.WriteRune(' ')
+			count++
+			continue
+		}
+
+		if _, ok := face.GlyphAdvance(r); !ok || !unicode.IsPrint(r) {
+			continue
+		}
+
+		b.WriteRune(r)
+		count++
+	}
+
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// wrapCaption breaks text into lines no wider than width. Words that don't
+// fit on a line of their own are split between runes.
+func wrapCaption(text string, face font.Face, width fixed.Int26_6) []string {
+	var lines []string
+	line := ""
+
+	for _, word := range strings.Fields(text) {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+
+		if font.MeasureString(face, candidate) <= width {
+			line = candidate
+			continue
+		}
+
+		if line != "" {
+			lines = append(lines, line)
+			line = ""
+		}
+
+		for font.MeasureString(face, word) > width {
+			runes := []rune(word)
+			n := 1
+
+			for n < len(runes) && font.MeasureString(face, string(runes[:n+1])) <= width {
+				n++
+			}
+
+			lines = append(lines, string(runes[:n]))
+			word = string(runes[n:])
+		}
+
+		line = word
+	}
+
+	if line != "" {
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// layoutCaption picks the largest font size at which each caption fits in a
+// third of the image height.
+func layoutCaption(caption Caption, bounds image.Rectangle) (face font.Face, top []string, bottom []string, err error) {
+	size := min(maxCaptionFontSize, max(minCaptionFontSize, float64(bounds.Dx())/9))
+	margin := bounds.Dx() / 20
+
+	for {
+		face, err = captionFace(size)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		width := fixed.I(bounds.Dx() - 2*margin)
+		lineHeight := face.Metrics().Height.Ceil()
+
+		top = wrapCaption(cleanCaption(caption.Top, face), face, width)
+		bottom = wrapCaption(cleanCaption(caption.Bottom, face), face, width)
+
+		if size <= minCaptionFontSize || max(len(top), len(bottom))*lineHeight <= bounds.Dy()/3 {
+			return face, top, bottom, nil
+		}
+
+		face.Close()
+		size = max(minCaptionFontSize, size*0.85)
+	}
+}
+
+// drawCaption draws white text with a black outline onto dst.
+func drawCaption(dst draw.Image, caption Caption) error {
+	bounds := dst.Bounds()
+
+	face, top, bottom, err := layoutCaption(caption, bounds)
+	if err != nil {
+		return err
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	lineHeight := metrics.Height.Ceil()
+	margin := bounds.Dy() / 40
+	outline := max(1, lineHeight/16)
+
+	drawLine := func(text string, y int) {
+		x := bounds.Min.X + (bounds.Dx()-font.MeasureString(face, text).Ceil())/2
+
+		d := &font.Drawer{Dst: dst, Face: face, Src: image.NewUniform(color.Black)}
+
+		for dy := -outline; dy <= outline; dy++ {
+			for dx := -outline; dx <= outline; dx++ {
+				if dx*dx+dy*dy > outline*outline {
+					continue
+				}
+
+				d.Dot = fixed.P(x+dx, y+dy)
+				d.DrawString(text)
+			}
+		}
+
+		d.Src = image.NewUniform(color.White)
+		d.Dot = fixed.P(x, y)
+		d.DrawString(text)
+	}
+
+	y := bounds.Min.Y + margin + metrics.Ascent.Ceil()
+	for _, line := range top {
+		drawLine(line, y)
+		y += lineHeight
+	}
+
+	y = bounds.Max.Y - margin - metrics.Descent.Ceil() - (len(bottom)-1)*lineHeight
+	for _, line := range bottom {
+		drawLine(line, y)
+		y += lineHeight
+	}
+
+	return nil
+}
+
+// captionImage returns a copy of img with the caption drawn on it.
+func captionImage(img image.Image, caption Caption) (image.Image, error) {
+	dst := image.NewNRGBA(img.Bounds())
+	draw.Draw(dst, dst.Rect, img, img.Bounds().Min, draw.Src)
+
+	if err := drawCaption(dst, caption); err != nil {
+		return nil, err
+	}
+
+	return dst, nil
+}
+
+// captionOverlay renders the caption on a transparent image, which ffmpeg
+// lays over every frame of a video.
+func captionOverlay(width int, height int, caption Caption) (*image.NRGBA, error) {
+	overlay := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	if err := drawCaption(overlay, caption); err != nil {
+		return nil, err
+	}
+
+	return overlay, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+func TestCaptionAnimatedGif(t *testing.T) {
+	useDefaultConfig(t)
+
+	palette := color.Palette{color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}}
+	g := &gif.GIF{Config: image.Config{Width: 120, Height: 80}}
+
+	for i := range 3 {
+		img := image.NewPaletted(image.Rect(0, 0, 120, 80), palette)
+		for p := range img.Pix {
+			img.Pix[p] = uint8(i % 2)
+		}
+		img.Pix[i] = 1 - uint8(i%2)
+
+		g.Image = append(g.Image, img)
+		g.Delay = append(g.Delay, 7)
+	}
+
+	source := new(bytes.Buffer)
+	if err := gif.EncodeAll(source, g); err != nil {
+		t.Fatalf("encoding: %v", err)
+	}
+
+	if media, err := sniffMedia(source.Bytes()); err != nil || media != MediaAnimatedGIF {
+		t.Fatalf("sniffMedia = %v, %v, want an animated GIF", media, err)
+	}
+
+	opts := DefaultVideoOptions()
+	opts.Caption = Caption{Top: "TOP", Bottom: "BOTTOM"}
+
+	converted, err := convertAttachment(nil, source.Bytes(), opts)
+	if err != nil {
+		t.Fatalf("convertAttachment: %v", err)
+	}
+
+	if converted.Format != FormatGIF {
+		t.Fatalf("format is %s, want GIF", converted.Format.Name)
+	}
+
+	out, err := gif.DecodeAll(converted.Data)
+	if err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+
+	frames := coalesceGif(out)
+	if len(frames) != 3 {
+		t.Fatalf("got %d frames, want 3", len(frames))
+	}
+
+	for i, frame := range frames {
+		if out.Delay[i] != 7 {
+			t.Errorf("frame %d: delay is %d, want 7", i, out.Delay[i])
+		}
+
+		// The caption is white text with a black outline.
+		white := 0
+		for p := 0; p < len(frame.Pix); p += 4 {
+			if frame.Pix[p] > 200 && frame.Pix[p+1] > 200 && frame.Pix[p+2] > 200 {
+				white++
+			}
+		}
+
+		if white == 0 {
+			t.Errorf("frame %d has no caption", i)
+		}
+	}
+}
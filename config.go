@@ -0,0 +1,537 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Discord    DiscordConfig    `yaml:"discord"`
+	Storage    StorageConfig    `yaml:"storage"`
+	Bunny      BunnyConfig      `yaml:"bunny"`
+	S3         S3Config         `yaml:"s3"`
+	Local      LocalConfig      `yaml:"local"`
+	Metrics    MetricsConfig    `yaml:"metrics"`
+	Vigil      VigilConfig      `yaml:"vigil"`
+	Instance   InstanceConfig   `yaml:"instance"`
+	Conversion ConversionConfig `yaml:"conversion"`
+	Database   DatabaseConfig   `yaml:"database"`
+	Queue      QueueConfig      `yaml:"queue"`
+	FFmpeg     FFmpegConfig     `yaml:"ffmpeg"`
+	Download   DownloadConfig   `yaml:"download"`
+	Decode     DecodeConfig     `yaml:"decode"`
+	// Guilds holds per guild overrides keyed by guild ID.
+	Guilds map[string]GuildConfig `yaml:"guilds"`
+}
+
+type DiscordConfig struct {
+	Token string `yaml:"token"`
+}
+
+type StorageConfig struct {
+	// Primary is the backend files are uploaded to: bunny, s3 or local.
+	Primary string `yaml:"primary"`
+	// Mirrors receive a copy of every upload in the background.
+	Mirrors []string `yaml:"mirrors"`
+	// PublicURL is the prefix of the links sent to users.
+	PublicURL string `yaml:"public_url"`
+}
+
+type BunnyConfig struct {
+	StorageZone   string `yaml:"storage_zone"`
+	StorageKey    string `yaml:"storage_key"`
+	StorageRegion string `yaml:"storage_region"`
+	APIKey        string `yaml:"api_key"`
+	PullZoneID    int64  `yaml:"pull_zone_id"`
+}
+
+type S3Config struct {
+	Region          string `yaml:"region"`
+	Endpoint        string `yaml:"endpoint"`
+	Bucket          string `yaml:"bucket"`
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	// UsePathStyle is needed for MinIO and most self hosted S3 servers.
+	UsePathStyle bool `yaml:"use_path_style"`
+}
+
+type LocalConfig struct {
+	Dir string `yaml:"dir"`
+	// ServeFiles starts the built-in file server when local is the primary backend.
+	ServeFiles bool   `yaml:"serve_files"`
+	ListenAddr string `yaml:"listen_addr"`
+}
+
+type MetricsConfig struct {
+	Addr string `yaml:"addr"`
+}
+
+type VigilConfig struct {
+	URL   string `yaml:"url"`
+	Token string `yaml:"token"`
+}
+
+type DatabaseConfig struct {
+	// Path is the SQLite file every conversion is recorded in.
+	Path string `yaml:"path"`
+}
+
+// QueueConfig is how many conversions of each kind run at once, the rest wait
+// in a queue.
+type QueueConfig struct {
+	ImageWorkers   int `yaml:"image_workers"`
+	VideoWorkers   int `yaml:"video_workers"`
+	ArchiveWorkers int `yaml:"archive_workers"`
+}
+
+// FFmpegConfig limits every ffmpeg and ffprobe process, the resource limits
+// are only applied on Linux.
+type FFmpegConfig struct {
+	// Timeout is how long converting one file may take, including every
+	// attempt to get it under the size limit.
+	Timeout time.Duration `yaml:"timeout"`
+	// MemoryLimitMB caps the address space of each process, 0 disables it.
+	MemoryLimitMB int `yaml:"memory_limit_mb"`
+	// CPUSeconds caps the CPU time of each process, 0 disables it.
+	CPUSeconds int `yaml:"cpu_seconds"`
+}
+
+// DownloadConfig limits downloading attachments from Discord.
+type DownloadConfig struct {
+	MaxSizeMB int `yaml:"max_size_mb"`
+	// Timeout is the deadline of every attempt.
+	Timeout time.Duration `yaml:"timeout"`
+	// Retries is how often network errors and 5xx responses are retried.
+	Retries int `yaml:"retries"`
+}
+
+func (d DownloadConfig) MaxBytes() int64 {
+	return int64(d.MaxSizeMB) << 20
+}
+
+// DecodeConfig limits the images and GIFs that are decoded, checked from
+// their headers before decoding.
+type DecodeConfig struct {
+	// MaxImagePixels is the largest width times height of an image.
+	MaxImagePixels int64 `yaml:"max_image_pixels"`
+	MaxGifFrames   int   `yaml:"max_gif_frames"`
+	// MaxGifPixels is the largest frame count times canvas size of a GIF.
+	MaxGifPixels int64 `yaml:"max_gif_pixels"`
+}
+
+type InstanceConfig struct {
+	Region string `yaml:"region"`
+	PodID  string `yaml:"pod_id"`
+}
+
+// ConversionConfig holds the upper bounds users can ask for in /gif.
+type ConversionConfig struct {
+	MaxFPS      int           `yaml:"max_fps"`
+	MaxWidth    int           `yaml:"max_width"`
+	MaxDuration time.Duration `yaml:"max_duration"`
+	// Delivery is how results are sent by default: link or attachment.
+	Delivery string `yaml:"delivery"`
+	// AlphaThreshold is the alpha (0-255) below which pixels of still images
+	// become transparent in GIFs.
+	AlphaThreshold int `yaml:"alpha_threshold"`
+	// Optimize runs the GIF optimizer on archived and generated GIFs.
+	Optimize bool `yaml:"optimize"`
+	// Lossy lets the optimizer treat pixels within this RGB distance (0-100)
+	// as unchanged between frames, 0 keeps GIFs lossless.
+	Lossy int `yaml:"lossy"`
+	// Quantizer, Dither and Colors are the default palette settings. The
+	// quantizer is only used for images, ffmpeg picks the palette of videos.
+	Quantizer string `yaml:"quantizer"`
+	Dither    string `yaml:"dither"`
+	Colors    int    `yaml:"colors"`
+}
+
+type GuildConfig struct {
+	Delivery  string `yaml:"delivery"`
+	Quantizer string `yaml:"quantizer"`
+	Dither    string `yaml:"dither"`
+	Colors    int    `yaml:"colors"`
+}
+
+// GuildDelivery returns the delivery mode configured for the guild.
+func (c *Config) GuildDelivery(guildID string) string {
+	if guild, ok := c.Guilds[guildID]; ok && guild.Delivery != "" {
+		return guild.Delivery
+	}
+
+	return c.Conversion.Delivery
+}
+
+// GuildQuantization returns the palette settings for the guild, falling back
+// to the conversion defaults for anything it doesn't set.
+func (c *Config) GuildQuantization(guildID string) Quantization {
+	q := Quantization{
+		Quantizer: c.Conversion.Quantizer,
+		Dither:    c.Conversion.Dither,
+		Colors:    c.Conversion.Colors,
+	}
+
+	guild := c.Guilds[guildID]
+
+	if guild.Quantizer != "" {
+		q.Quantizer = guild.Quantizer
+	}
+
+	if guild.Dither != "" {
+		q.Dither = guild.Dither
+	}
+
+	if guild.Colors != 0 {
+		q.Colors = guild.Colors
+	}
+
+	return q
+}
+
+var AppConfig *Config
+
+func defaultConfig() *Config {
+	metricsAddr := "127.0.0.1:2112"
+	fileServerAddr := "127.0.0.1:8080"
+	databasePath := "png2gif.db"
+
+	if isRunningInDocker() {
+		metricsAddr = ":2112"
+		fileServerAddr = ":8080"
+		databasePath = "data/png2gif.db"
+	}
+
+	return &Config{
+		Storage: StorageConfig{
+			Primary: "bunny",
+			Mirrors: []string{"s3"},
+		},
+		Local: LocalConfig{
+			Dir:        "files",
+			ServeFiles: true,
+			ListenAddr: fileServerAddr,
+		},
+		Metrics: MetricsConfig{
+			Addr: metricsAddr,
+		},
+		Database: DatabaseConfig{
+			Path: databasePath,
+		},
+		Queue: QueueConfig{
+			ImageWorkers:   4,
+			VideoWorkers:   2,
+			ArchiveWorkers: 2,
+		},
+		FFmpeg: FFmpegConfig{
+			Timeout:       2 * time.Minute,
+			MemoryLimitMB: 2048,
+			CPUSeconds:    600,
+		},
+		Download: DownloadConfig{
+			MaxSizeMB: 100,
+			Timeout:   60 * time.Second,
+			Retries:   2,
+		},
+		Decode: DecodeConfig{
+			MaxImagePixels: 40_000_000,
+			MaxGifFrames:   1000,
+			MaxGifPixels:   100_000_000,
+		},
+		Conversion: ConversionConfig{
+			MaxFPS:         30,
+			MaxWidth:       1024,
+			MaxDuration:    30 * time.Second,
+			Delivery:       DeliveryLink,
+			AlphaThreshold: 128,
+			Optimize:       true,
+			Quantizer:      QuantizerPopularity,
+			Dither:         "bayer",
+			Colors:         256,
+		},
+	}
+}
+
+// LoadConfig reads the YAML file at CONFIG_FILE (config.yaml by default), applies
+// environment variable overrides on top of it and validates the result.
+func LoadConfig() (*Config, error) {
+	cfg := defaultConfig()
+
+	path := envOr("CONFIG_FILE", "config.yaml")
+
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	case errors.Is(err, fs.ErrNotExist) && os.Getenv("CONFIG_FILE") == "":
+		// Running purely from environment variables.
+	default:
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (c *Config) applyEnv() error {
+	stringVars := map[string]*string{
+		"BOT_TOKEN":                   &c.Discord.Token,
+		"STORAGE_PRIMARY":             &c.Storage.Primary,
+		"PUBLIC_BASE_URL":             &c.Storage.PublicURL,
+		"BUNNYNET_CDN_STORAGE_NAME":   &c.Bunny.StorageZone,
+		"BUNNYNET_CDN_STORAGE_KEY":    &c.Bunny.StorageKey,
+		"BUNNYNET_CDN_STORAGE_REGION": &c.Bunny.StorageRegion,
+		"BUNNYNET_API_KEY":            &c.Bunny.APIKey,
+		"S3_REGION":                   &c.S3.Region,
+		"S3_ENDPOINT":                 &c.S3.Endpoint,
+		"S3_BUCKET":                   &c.S3.Bucket,
+		"S3_ACCESS_KEY_ID":            &c.S3.AccessKeyID,
+		"S3_SECRET_ACCESS_KEY":        &c.S3.SecretAccessKey,
+		"LOCAL_STORAGE_DIR":           &c.Local.Dir,
+		"FILE_SERVER_ADDR":            &c.Local.ListenAddr,
+		"METRICS_ADDR":                &c.Metrics.Addr,
+		"DATABASE_PATH":               &c.Database.Path,
+		"VIGIL_REPORTER_URL":          &c.Vigil.URL,
+		"VIGIL_REPORTER_TOKEN":        &c.Vigil.Token,
+		"BUNNYNET_MC_REGION":          &c.Instance.Region,
+		"BUNNYNET_MC_PODID":           &c.Instance.PodID,
+	}
+
+	for env, dst := range stringVars {
+		if value := os.Getenv(env); value != "" {
+			*dst = value
+		}
+	}
+
+	boolVars := map[string]*bool{
+		"S3_USE_PATH_STYLE": &c.S3.UsePathStyle,
+	}
+
+	for env, dst := range boolVars {
+		if value := os.Getenv(env); value != "" {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not a boolean", env, value)
+			}
+			*dst = b
+		}
+	}
+
+	if value := os.Getenv("FILE_SERVER_DISABLED"); value != "" {
+		disabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("FILE_SERVER_DISABLED: %q is not a boolean", value)
+		}
+		c.Local.ServeFiles = !disabled
+	}
+
+	intVars := map[string]*int{
+		"QUEUE_IMAGE_WORKERS":    &c.Queue.ImageWorkers,
+		"QUEUE_VIDEO_WORKERS":    &c.Queue.VideoWorkers,
+		"QUEUE_ARCHIVE_WORKERS":  &c.Queue.ArchiveWorkers,
+		"FFMPEG_MEMORY_LIMIT_MB": &c.FFmpeg.MemoryLimitMB,
+		"FFMPEG_CPU_SECONDS":     &c.FFmpeg.CPUSeconds,
+		"DOWNLOAD_MAX_SIZE_MB":   &c.Download.MaxSizeMB,
+		"DOWNLOAD_RETRIES":       &c.Download.Retries,
+	}
+
+	for env, dst := range intVars {
+		if value := os.Getenv(env); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not a number", env, value)
+			}
+			*dst = n
+		}
+	}
+
+	durationVars := map[string]*time.Duration{
+		"FFMPEG_TIMEOUT":   &c.FFmpeg.Timeout,
+		"DOWNLOAD_TIMEOUT": &c.Download.Timeout,
+	}
+
+	for env, dst := range durationVars {
+		if value := os.Getenv(env); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not a duration", env, value)
+			}
+			*dst = d
+		}
+	}
+
+	if value := os.Getenv("BUNNYNET_PULL_ZONE_ID"); value != "" {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("BUNNYNET_PULL_ZONE_ID: %q is not a number", value)
+		}
+		c.Bunny.PullZoneID = id
+	}
+
+	if value := os.Getenv("STORAGE_MIRRORS"); value != "" {
+		c.Storage.Mirrors = nil
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" && name != "none" {
+				c.Storage.Mirrors = append(c.Storage.Mirrors, name)
+			}
+		}
+	}
+
+	// The file server of the local backend is the only public URL that can be
+	// guessed, every other deployment has to name its own.
+	if c.Storage.PublicURL == "" && c.Storage.Primary == "local" && c.Local.ServeFiles {
+		if _, port, err := net.SplitHostPort(c.Local.ListenAddr); err == nil {
+			c.Storage.PublicURL = "http://localhost:" + port
+		}
+	}
+
+	c.Storage.PublicURL = strings.TrimSuffix(c.Storage.PublicURL, "/")
+
+	return nil
+}
+
+// Validate reports every problem with the configuration at once, naming both
+// the config key and the environment variable that can be used to set it.
+func (c *Config) Validate() error {
+	var errs []error
+
+	require := func(value string, key string, env string) {
+		if value == "" {
+			errs = append(errs, fmt.Errorf("%s is required (or set %s)", key, env))
+		}
+	}
+
+	require(c.Discord.Token, "discord.token", "BOT_TOKEN")
+
+	backends := append([]string{c.Storage.Primary}, c.Storage.Mirrors...)
+	seen := map[string]bool{}
+
+	for _, backend := range backends {
+		if seen[backend] {
+			errs = append(errs, fmt.Errorf("storage backend %q is used more than once", backend))
+			continue
+		}
+		seen[backend] = true
+
+		switch backend {
+		case "bunny":
+			require(c.Bunny.StorageZone, "bunny.storage_zone", "BUNNYNET_CDN_STORAGE_NAME")
+			require(c.Bunny.StorageKey, "bunny.storage_key", "BUNNYNET_CDN_STORAGE_KEY")
+		case "s3":
+			require(c.S3.Region, "s3.region", "S3_REGION")
+			require(c.S3.Bucket, "s3.bucket", "S3_BUCKET")
+			require(c.S3.AccessKeyID, "s3.access_key_id", "S3_ACCESS_KEY_ID")
+			require(c.S3.SecretAccessKey, "s3.secret_access_key", "S3_SECRET_ACCESS_KEY")
+		case "local":
+			require(c.Local.Dir, "local.dir", "LOCAL_STORAGE_DIR")
+		default:
+			errs = append(errs, fmt.Errorf("unknown storage backend %q, expected bunny, s3 or local", backend))
+		}
+	}
+
+	require(c.Storage.PublicURL, "storage.public_url", "PUBLIC_BASE_URL")
+
+	if u, err := url.Parse(c.Storage.PublicURL); c.Storage.PublicURL != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+		errs = append(errs, fmt.Errorf("storage.public_url %q must be an absolute http(s) URL", c.Storage.PublicURL))
+	}
+
+	if c.Storage.Primary == "local" && c.Local.ServeFiles && c.Local.ListenAddr == "" {
+		errs = append(errs, fmt.Errorf("local.listen_addr is required when serving files (or set FILE_SERVER_ADDR)"))
+	}
+
+	if c.Metrics.Addr == "" {
+		errs = append(errs, fmt.Errorf("metrics.addr is required (or set METRICS_ADDR)"))
+	}
+
+	if c.Database.Path == "" {
+		errs = append(errs, fmt.Errorf("database.path is required (or set DATABASE_PATH)"))
+	}
+
+	if c.Queue.ImageWorkers < 1 || c.Queue.VideoWorkers < 1 || c.Queue.ArchiveWorkers < 1 {
+		errs = append(errs, fmt.Errorf("queue.image_workers, queue.video_workers and queue.archive_workers must be at least 1"))
+	}
+
+	if c.FFmpeg.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("ffmpeg.timeout must be positive (or set FFMPEG_TIMEOUT)"))
+	}
+
+	if c.FFmpeg.MemoryLimitMB < 0 || c.FFmpeg.CPUSeconds < 0 {
+		errs = append(errs, fmt.Errorf("ffmpeg.memory_limit_mb and ffmpeg.cpu_seconds can't be negative"))
+	}
+
+	if c.Download.MaxSizeMB < 1 || c.Download.Timeout <= 0 || c.Download.Retries < 0 {
+		errs = append(errs, fmt.Errorf("download.max_size_mb and download.timeout must be positive and download.retries can't be negative"))
+	}
+
+	if c.Decode.MaxImagePixels < 1 || c.Decode.MaxGifFrames < 1 || c.Decode.MaxGifPixels < 1 {
+		errs = append(errs, fmt.Errorf("decode.max_image_pixels, decode.max_gif_frames and decode.max_gif_pixels must be positive"))
+	}
+
+	if c.Conversion.MaxFPS < 1 || c.Conversion.MaxWidth < 16 || c.Conversion.MaxDuration <= 0 {
+		errs = append(errs, fmt.Errorf("conversion.max_fps, conversion.max_width and conversion.max_duration must be positive"))
+	}
+
+	if c.Conversion.AlphaThreshold < 0 || c.Conversion.AlphaThreshold > 255 {
+		errs = append(errs, fmt.Errorf("conversion.alpha_threshold %d must be between 0 and 255", c.Conversion.AlphaThreshold))
+	}
+
+	if c.Conversion.Lossy < 0 || c.Conversion.Lossy > 100 {
+		errs = append(errs, fmt.Errorf("conversion.lossy %d must be between 0 and 100", c.Conversion.Lossy))
+	}
+
+	if !validDelivery(c.Conversion.Delivery) {
+		errs = append(errs, fmt.Errorf("conversion.delivery %q must be link or attachment", c.Conversion.Delivery))
+	}
+
+	validateQuantization := func(prefix string, q Quantization) {
+		if _, ok := quantizers[q.Quantizer]; q.Quantizer != "" && !ok {
+			errs = append(errs, fmt.Errorf("%s.quantizer %q must be popularity, mediancut or octree", prefix, q.Quantizer))
+		}
+
+		if _, ok := ditherModes[q.Dither]; q.Dither != "" && !ok {
+			errs = append(errs, fmt.Errorf("%s.dither %q must be bayer, sierra2_4a, floyd_steinberg or none", prefix, q.Dither))
+		}
+
+		if q.Colors != 0 && (q.Colors < 4 || q.Colors > 256) {
+			errs = append(errs, fmt.Errorf("%s.colors %d must be between 4 and 256", prefix, q.Colors))
+		}
+	}
+
+	if c.Conversion.Quantizer == "" || c.Conversion.Dither == "" || c.Conversion.Colors == 0 {
+		errs = append(errs, fmt.Errorf("conversion.quantizer, conversion.dither and conversion.colors can't be empty"))
+	}
+
+	validateQuantization("conversion", Quantization{c.Conversion.Quantizer, c.Conversion.Dither, c.Conversion.Colors})
+
+	for id, guild := range c.Guilds {
+		if guild.Delivery != "" && !validDelivery(guild.Delivery) {
+			errs = append(errs, fmt.Errorf("guilds.%s.delivery %q must be link or attachment", id, guild.Delivery))
+		}
+
+		validateQuantization("guilds."+id, Quantization{guild.Quantizer, guild.Dither, guild.Colors})
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+
+	return nil
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	DeliveryLink       = "link"
+	DeliveryAttachment = "attachment"
+)
+
+func validDelivery(mode string) bool {
+	return mode == DeliveryLink || mode == DeliveryAttachment
+}
+
+// Delivery decides how finished files reach the user.
+type Delivery struct {
+	Mode string
+	// MaxAttachmentBytes is the upload limit of the guild, larger files are
+	// uploaded to storage and linked instead.
+	MaxAttachmentBytes int64
+}
+
+// guildDelivery is the configured delivery for the guild the interaction ran in.
+func guildDelivery(s *discordgo.Session, i *discordgo.InteractionCreate) Delivery {
+	return Delivery{
+		Mode:               AppConfig.GuildDelivery(i.GuildID),
+		MaxAttachmentBytes: guildUploadLimit(s, i.GuildID),
+	}
+}
+
+// Converted is the output of a conversion.
+type Converted struct {
+	Data   *bytes.Buffer
+	Format OutputFormat
+	// Note is shown next to the link, eg. the settings a GIF was shrunk to.
+	Note string
+}
+
+// convertedGif wraps converters that only produce GIF bytes.
+func convertedGif(buf *bytes.Buffer, err error) (*Converted, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	return &Converted{Data: buf, Format: FormatGIF}, nil
+}
+
+// Converter is one kind of conversion run by processAttachments.
+type Converter struct {
+	// Params describes the settings. Converting the same source with the same
+	// params is assumed to give the same file, so it's only done once.
+	Params string
+	// Format is the format the output for a source of the media will have.
+	Format  func(media Media) OutputFormat
+	Convert func(attachment *discordgo.MessageAttachment, source []byte) (*Converted, error)
+}
+
+// gifConverter is a converter that always produces GIFs.
+func gifConverter(params string, convert func(attachment *discordgo.MessageAttachment, source []byte) (*bytes.Buffer, error)) Converter {
+	return Converter{
+		Params: params,
+		Format: func(Media) OutputFormat { return FormatGIF },
+		Convert: func(attachment *discordgo.MessageAttachment, source []byte) (*Converted, error) {
+			return convertedGif(convert(attachment, source))
+		},
+	}
+}
+
+// attachmentConverter converts images and videos with opts.
+func attachmentConverter(opts VideoOptions) Converter {
+	return Converter{
+		Params: fmt.Sprintf("convert %+v", opts),
+		Format: func(media Media) OutputFormat {
+			// Single images can't be animated, APNG becomes a plain PNG.
+			if media.Pipeline == PipelineImage && !media.Animated && opts.Format == FormatAPNG {
+				return FormatPNG
+			}
+
+			return opts.Format
+		},
+		Convert: func(attachment *discordgo.MessageAttachment, source []byte) (*Converted, error) {
+			return convertAttachment(attachment, source, opts)
+		},
+	}
+}
+
+// videoOnly makes c refuse everything but videos, for commands that only make
+// sense on them.
+func videoOnly(c Converter) Converter {
+	convert := c.Convert
+
+	c.Convert = func(attachment *discordgo.MessageAttachment, source []byte) (*Converted, error) {
+		media, err := sniffMedia(source)
+		if err != nil {
+			return nil, err
+		}
+
+		if media.Pipeline != PipelineVideo {
+			return nil, newUserError("Unsupported format: %s, this only works on videos.", media.Name)
+		}
+
+		return convert(attachment, source)
+	}
+
+	return c
+}
+
+// convertAttachment picks the pipeline by the format of the source, not the
+// content type Discord guessed.
+func convertAttachment(attachment *discordgo.MessageAttachment, source []byte, videoOpts VideoOptions) (*Converted, error) {
+	media, err := sniffMedia(source)
+	if err != nil {
+		return nil, err
+	}
+
+	if media.Pipeline == PipelineVideo {
+		// Width also resizes videos, the rest of the transform doesn't.
+		transform := videoOpts.Transform
+		transform.Width = 0
+
+		if !transform.Empty() {
+			return nil, newUserError("Crop, aspect, rotate and flip only work on images.")
+		}
+
+		return encodeVideoSource(media, source, videoOpts)
+	}
+
+	if media.Animated {
+		return encodeAnimatedGif(source, videoOpts)
+	}
+
+	return encodeImage(source, videoOpts)
+}
+
+// contentName is the file name, without extension, of the result of
+// converting source with params. The conversion settings from the config
+// are part of it so changing them doesn't serve stale files.
+func contentName(source []byte, params string) string {
+	sourceHash := sha256.Sum256(source)
+
+	c := AppConfig.Conversion
+	h := sha256.New()
+	fmt.Fprintf(h, "%x\n%s\n%d %t %d", sourceHash, params, c.AlphaThreshold, c.Optimize, c.Lossy)
+
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// processAttachments converts the attachments concurrently, uploads the
+// results and edits the interaction response with the links. Results that
+// were already uploaded are linked without converting them again.
+func processAttachments(s *discordgo.Session, i *discordgo.InteractionCreate, attachments []*discordgo.MessageAttachment, message *discordgo.Message, delivery Delivery, converter Converter) {
+	processingMsg := "Processing file..."
+
+	if len(attachments) > 1 {
+		processingMsg = "Processing files..."
+	}
+
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Flags:   discordgo.MessageFlagsEphemeral,
+			Content: processingMsg,
+		},
+	})
+
+	var links []string
+	var reasons []string
+	var buttons []discordgo.MessageComponent
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failedCount := 0
+	attachedCount := 0
+
+	userID := interactionUser(i).ID
+	jobs := make([]queuedJob, len(attachments))
+
+	stopProgress := reportProgress(s, i, processingMsg, func() string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return progressMessage(jobs)
+	})
+
+	for n, a := range attachments {
+		wg.Add(1)
+
+		go func(n int, attachment *discordgo.MessageAttachment) {
+			defer wg.Done()
+
+			defer func() {
+				mu.Lock()
+				jobs[n].done = true
+				mu.Unlock()
+			}()
+
+			fail := func(err error) {
+				fmt.Println("error processing attachment:", err)
+				mu.Lock()
+				failedCount++
+				var uerr *userError
+				if errors.As(err, &uerr) {
+					reasons = append(reasons, fmt.Sprintf("%s: %s", attachment.Filename, uerr.msg))
+				}
+				mu.Unlock()
+			}
+
+			// The queue depends on the format, which only the first bytes of
+			// the file can tell. The whole file is downloaded once a worker is
+			// free, so waiting jobs don't hold it in memory.
+			head, err := downloadHead(attachment, sniffLength)
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			kind, err := sniffMedia(head)
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			queue := jobQueues[jobKind(kind)]
+			t := queue.Enqueue(userID)
+
+			mu.Lock()
+			jobs[n] = queuedJob{queue: queue, ticket: t}
+			mu.Unlock()
+
+			// Interaction tokens expire after 15 minutes, after that the
+			// result couldn't be sent anyway.
+			ctx, cancel := context.WithTimeout(context.Background(), maxQueueWait)
+			defer cancel()
+
+			if err := queue.Wait(ctx, t); err != nil {
+				fail(newUserError("The queue is too long right now, try again later."))
+				return
+			}
+
+			release := sync.OnceFunc(queue.Release)
+			defer release()
+
+			started := time.Now()
+
+			source, err := downloadAttachment(attachment)
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			// record indexes the conversion and adds a delete button for
+			// stored files.
+			record := func(rec ConversionRecord) {
+				rec.AttachmentID = attachment.ID
+				rec.SourceName = attachment.Filename
+				rec.SourceSize = int64(len(source))
+				rec.Params = converter.Params
+				rec.TotalTime = time.Since(started)
+
+				id := recordConversion(i, message, rec)
+				if id == 0 || rec.ObjectKey == "" {
+					return
+				}
+
+				mu.Lock()
+				buttons = append(buttons, deleteButton(id, attachment.Filename))
+				mu.Unlock()
+			}
+
+			media, err := sniffMedia(source)
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			name := contentName(source, converter.Params)
+			format := converter.Format(media)
+
+			fileName := fmt.Sprintf("%s%s", name, format.Ext)
+
+			if !isRunningInDocker() {
+				fileName = fmt.Sprintf("%s_devenv%s", name, format.Ext)
+			}
+
+			if delivery.Mode == DeliveryLink {
+				key := storageKey(format.Dir, fileName)
+
+				info, err := FileStorage.Stat(context.Background(), key)
+				if err == nil {
+					slog.Info("[STORAGE] Reusing existing file", "file", fileName)
+					conversionCacheHits.Inc()
+					record(ConversionRecord{ObjectKey: key, Format: format.Name, Delivery: DeliveryLink, Reused: true, OutputSize: info.Size})
+
+					mu.Lock()
+					links = append(links, publicURL(key))
+					mu.Unlock()
+					return
+				}
+
+				if !errors.Is(err, ErrObjectNotFound) {
+					slog.Warn("[STORAGE] Failed to look up existing file", "file", fileName, "error", err)
+				}
+			}
+
+			convertStarted := time.Now()
+
+			result, err := converter.Convert(attachment, source)
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			convertTime := time.Since(convertStarted)
+			release()
+
+			if result.Format != format {
+				slog.Warn("[CONVERT] Output format differs from the expected one", "expected", format.Name, "got", result.Format.Name)
+				format = result.Format
+				fileName = strings.TrimSuffix(fileName, path.Ext(fileName)) + format.Ext
+			}
+
+			if delivery.Mode == DeliveryAttachment && int64(result.Data.Len()) <= delivery.MaxAttachmentBytes {
+				_, err := s.FollowupMessageCreate(i.Interaction, true, &discordgo.WebhookParams{
+					Content: result.Note,
+					Flags:   discordgo.MessageFlagsEphemeral,
+					Files: []*discordgo.File{
+						{
+							Name:        fileName,
+							ContentType: result.Format.ContentType,
+							Reader:      bytes.NewReader(result.Data.Bytes()),
+						},
+					},
+				})
+				if err == nil {
+					record(ConversionRecord{Format: result.Format.Name, Delivery: DeliveryAttachment, OutputSize: int64(result.Data.Len()), ConvertTime: convertTime})
+
+					mu.Lock()
+					attachedCount++
+					mu.Unlock()
+					return
+				}
+
+				slog.Error("[DISCORD] Failed to send file as attachment, uploading instead", "file", fileName, "error", err)
+			}
+
+			checksum := fmt.Sprintf("%X", sha256.Sum256(result.Data.Bytes()))
+			outputSize := int64(result.Data.Len())
+
+			err = Upload(context.Background(), result.Format.Dir, fileName, checksum, result.Data)
+			if err != nil {
+				fmt.Println("Error uploading file:", err)
+				mu.Lock()
+				failedCount++
+				mu.Unlock()
+				return
+			}
+
+			key := storageKey(result.Format.Dir, fileName)
+			record(ConversionRecord{ObjectKey: key, Format: result.Format.Name, Delivery: DeliveryLink, OutputSize: outputSize, ConvertTime: convertTime})
+
+			link := publicURL(key)
+
+			if result.Note != "" {
+				link += " (" + result.Note + ")"
+			}
+
+			mu.Lock()
+			links = append(links, link)
+			mu.Unlock()
+		}(n, a)
+	}
+
+	wg.Wait()
+	stopProgress()
+
+	failedCountMessage := " file failed to process."
+
+	if failedCount > 1 {
+		failedCountMessage = " files failed to process."
+	}
+
+	joined := strings.Join(links, "\n")
+
+	if attachedCount > 0 {
+		if joined != "" {
+			joined += "\n"
+		}
+		joined += fmt.Sprintf("Sent %d as attachment.", attachedCount)
+	}
+
+	if failedCount > 0 {
+		joined += fmt.Sprintf("\n\n%d %s", failedCount, failedCountMessage)
+	}
+
+	if len(reasons) > 0 {
+		joined += "\n" + strings.Join(reasons, "\n")
+	}
+
+	components := deleteButtonRows(buttons)
+
+	s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+		Content:    &joined,
+		Components: &components,
+	})
+}
+
+// recordConversion adds a finished conversion to the index and returns its ID.
+// Failing to record it is only logged, the user still gets their file.
+func recordConversion(i *discordgo.InteractionCreate, message *discordgo.Message, rec ConversionRecord) int64 {
+	if Conversions == nil {
+		return 0
+	}
+
+	if user := interactionUser(i); user != nil {
+		rec.UserID = user.ID
+	}
+
+	rec.GuildID = i.GuildID
+	rec.ChannelID = i.ChannelID
+
+	if message != nil {
+		rec.MessageID = message.ID
+		rec.ChannelID = message.ChannelID
+	}
+
+	id, err := Conversions.Record(context.Background(), rec)
+	if err != nil {
+		slog.Error("[DATABASE] Failed to record conversion", "key", rec.ObjectKey, "error", err)
+		return 0
+	}
+
+	return id
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// migrations are applied in order, the schema version is kept in the
+// database's user_version.
+var migrations = []string{
+	`CREATE TABLE conversions (
+		id            INTEGER PRIMARY KEY AUTOINCREMENT,
+		object_key    TEXT    NOT NULL DEFAULT '',
+		format        TEXT    NOT NULL,
+		delivery      TEXT    NOT NULL,
+		reused        INTEGER NOT NULL DEFAULT 0,
+		user_id       TEXT    NOT NULL,
+		guild_id      TEXT    NOT NULL DEFAULT '',
+		channel_id    TEXT    NOT NULL DEFAULT '',
+		message_id    TEXT    NOT NULL DEFAULT '',
+		attachment_id TEXT    NOT NULL,
+		source_name   TEXT    NOT NULL,
+		source_size   INTEGER NOT NULL,
+		output_size   INTEGER NOT NULL,
+		params        TEXT    NOT NULL,
+		convert_ms    INTEGER NOT NULL,
+		total_ms      INTEGER NOT NULL,
+		created_at    INTEGER NOT NULL,
+		deleted_at    INTEGER
+	);
+	CREATE INDEX conversions_user ON conversions (user_id, created_at);
+	CREATE INDEX conversions_object ON conversions (object_key);`,
+}
+
+// ConversionRecord is one file produced for a user. ObjectKey is empty when
+// the file was only sent as an attachment and never stored.
+type ConversionRecord struct {
+	ID        int64
+	ObjectKey string
+	Format    string
+	Delivery  string
+	// Reused is set when an existing upload was linked instead of converting.
+	Reused       bool
+	UserID       string
+	GuildID      string
+	ChannelID    string
+	MessageID    string
+	AttachmentID string
+	SourceName   string
+	SourceSize   int64
+	OutputSize   int64
+	Params       string
+	// ConvertTime is the time spent converting, TotalTime includes the
+	// download and upload.
+	ConvertTime time.Duration
+	TotalTime   time.Duration
+	CreatedAt   time.Time
+	DeletedAt   time.Time
+}
+
+// ConversionIndex stores every conversion in an embedded SQLite database.
+type ConversionIndex struct {
+	db *sql.DB
+}
+
+var Conversions *ConversionIndex
+
+// OpenConversionIndex opens, or creates, the database at path and brings its
+// schema up to date.
+func OpenConversionIndex(path string) (*ConversionIndex, error) {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("creating database directory: %w", err)
+		}
+	}
+
+	dsn := "file:" + path + "?" + url.Values{
+		"_pragma": {"busy_timeout(5000)", "journal_mode(WAL)", "synchronous(NORMAL)"},
+	}.Encode()
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("opening database: %w", err)
+	}
+
+	index := &ConversionIndex{db: db}
+
+	if err := index.migrate(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return index, nil
+}
+
+func (x *ConversionIndex) migrate(ctx context.Context) error {
+	var version int
+	if err := x.db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("reading schema version: %w", err)
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := x.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, migrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrating database to version %d: %w", version+1, err)
+		}
+
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrating database to version %d: %w", version+1, err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migrating database to version %d: %w", version+1, err)
+		}
+	}
+
+	return nil
+}
+
+func (x *ConversionIndex) Close() error {
+	return x.db.Close()
+}
+
+// Record stores rec and returns its ID. CreatedAt defaults to now.
+func (x *ConversionIndex) Record(ctx context.Context, rec ConversionRecord) (int64, error) {
+	if rec.CreatedAt.IsZero() {
+		rec.CreatedAt = time.Now()
+	}
+
+	res, err := x.db.ExecContext(ctx, `INSERT INTO conversions (
+		object_key, format, delivery, reused, user_id, guild_id, channel_id, message_id,
+		attachment_id, source_name, source_size, output_size, params, convert_ms, total_ms, created_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rec.ObjectKey, rec.Format, rec.Delivery, rec.Reused, rec.UserID, rec.GuildID, rec.ChannelID, rec.MessageID,
+		rec.AttachmentID, rec.SourceName, rec.SourceSize, rec.OutputSize, rec.Params,
+		rec.ConvertTime.Milliseconds(), rec.TotalTime.Milliseconds(), rec.CreatedAt.UnixMilli(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("recording conversion: %w", err)
+	}
+
+	return res.LastInsertId()
+}
+
+var ErrConversionNotFound = errors.New("conversion not found")
+
+const conversionColumns = `id, object_key, format, delivery, reused, user_id, guild_id, channel_id, message_id,
+	attachment_id, source_name, source_size, output_size, params, convert_ms, total_ms, created_at, deleted_at`
+
+func scanConversion(row interface{ Scan(...any) error }) (ConversionRecord, error) {
+	var rec ConversionRecord
+	var convertMs, totalMs, createdAt int64
+	var deletedAt sql.NullInt64
+
+	err := row.Scan(
+		&rec.ID, &rec.ObjectKey, &rec.Format, &rec.Delivery, &rec.Reused, &rec.UserID, &rec.GuildID, &rec.ChannelID, &rec.MessageID,
+		&rec.AttachmentID, &rec.SourceName, &rec.SourceSize, &rec.OutputSize, &rec.Params, &convertMs, &totalMs, &createdAt, &deletedAt,
+	)
+	if err != nil {
+		return rec, err
+	}
+
+	rec.ConvertTime = time.Duration(convertMs) * time.Millisecond
+	rec.TotalTime = time.Duration(totalMs) * time.Millisecond
+	rec.CreatedAt = time.UnixMilli(createdAt)
+
+	if deletedAt.Valid {
+		rec.DeletedAt = time.UnixMilli(deletedAt.Int64)
+	}
+
+	return rec, nil
+}
+
+// UserConversions returns a page of the stored files a user created, newest
+// first, and how many there are in total. Converting the same file twice only
+// lists it once.
+func (x *ConversionIndex) UserConversions(ctx context.Context, userID string, offset int, limit int) ([]ConversionRecord, int, error) {
+	var total int
+
+	err := x.db.QueryRowContext(ctx, `SELECT COUNT(DISTINCT object_key) FROM conversions
+		WHERE user_id = ? AND object_key != '' AND deleted_at IS NULL`, userID).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("counting conversions: %w", err)
+	}
+
+	rows, err := x.db.QueryContext(ctx, `SELECT `+conversionColumns+` FROM conversions
+		WHERE id IN (
+			SELECT MAX(id) FROM conversions
+			WHERE user_id = ? AND object_key != '' AND deleted_at IS NULL
+			GROUP BY object_key
+		)
+		ORDER BY id DESC LIMIT ? OFFSET ?`, userID, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("listing conversions: %w", err)
+	}
+	defer rows.Close()
+
+	var records []ConversionRecord
+
+	for rows.Next() {
+		rec, err := scanConversion(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("listing conversions: %w", err)
+		}
+
+		records = append(records, rec)
+	}
+
+	return records, total, rows.Err()
+}
+
+// UserConversion returns one of the conversions of a user.
+func (x *ConversionIndex) UserConversion(ctx context.Context, userID string, id int64) (ConversionRecord, error) {
+	row := x.db.QueryRowContext(ctx, `SELECT `+conversionColumns+` FROM conversions
+		WHERE id = ? AND user_id = ? AND deleted_at IS NULL`, id, userID)
+
+	rec, err := scanConversion(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return rec, ErrConversionNotFound
+	}
+
+	return rec, err
+}
+
+// KeyOwners returns the users that still have the stored file in their
+// conversions.
+func (x *ConversionIndex) KeyOwners(ctx context.Context, key string) ([]string, error) {
+	rows, err := x.db.QueryContext(ctx, `SELECT DISTINCT user_id FROM conversions
+		WHERE object_key = ? AND deleted_at IS NULL`, key)
+	if err != nil {
+		return nil, fmt.Errorf("looking up owners: %w", err)
+	}
+	defer rows.Close()
+
+	var owners []string
+
+	for rows.Next() {
+		var owner string
+		if err := rows.Scan(&owner); err != nil {
+			return nil, fmt.Errorf("looking up owners: %w", err)
+		}
+
+		owners = append(owners, owner)
+	}
+
+	return owners, rows.Err()
+}
+
+// MarkDeleted records that the user deleted the stored file.
+func (x *ConversionIndex) MarkDeleted(ctx context.Context, userID string, key string) error {
+	_, err := x.db.ExecContext(ctx, `UPDATE conversions SET deleted_at = ?
+		WHERE user_id = ? AND object_key = ? AND deleted_at IS NULL`, time.Now().UnixMilli(), userID, key)
+	if err != nil {
+		return fmt.Errorf("marking conversion deleted: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+)
+
+var errInvalidGif = errors.New("invalid GIF")
+
+// checkImageSize reads the dimensions from the header of an image, before
+// anything is decoded, and rejects images that would take too much memory.
+func checkImageSize(source []byte) error {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(source))
+	if err != nil {
+		decodeRejections.WithLabelValues("invalid").Inc()
+		return fmt.Errorf("failed to read image header: %w", err)
+	}
+
+	limits := AppConfig.Decode
+
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > limits.MaxImagePixels {
+		decodeRejections.WithLabelValues("image_pixels").Inc()
+		return newUserError("The image is %dx%d, at most %d megapixels are supported.", cfg.Width, cfg.Height, limits.MaxImagePixels/1_000_000)
+	}
+
+	if format == "gif" {
+		return checkGifBudget(source)
+	}
+
+	return nil
+}
+
+// checkGifBudget walks the blocks of a GIF without decompressing any frames
+// and rejects it when it has too many frames, or when all frames together
+// are more pixels than the budget. Every frame is expanded to the full canvas
+// when editing, so that's the size counted per frame.
+func checkGifBudget(source []byte) error {
+	frames, canvas, err := scanGif(source)
+	if err != nil {
+		decodeRejections.WithLabelValues("invalid").Inc()
+		return err
+	}
+
+	limits := AppConfig.Decode
+
+	switch gifOverBudget(frames, canvas) {
+	case "gif_frames":
+		decodeRejections.WithLabelValues("gif_frames").Inc()
+		return newUserError("The GIF has %d frames, at most %d are supported.", frames, limits.MaxGifFrames)
+	case "gif_pixels":
+		decodeRejections.WithLabelValues("gif_pixels").Inc()
+		return newUserError("The GIF is too large, %d frames at this size are more than %d megapixels in total.", frames, limits.MaxGifPixels/1_000_000)
+	}
+
+	return nil
+}
+
+// gifOverBudget returns which decode limit a GIF with frames frames on a
+// canvas of canvas pixels is over, gif_frames or gif_pixels, or "" when it
+// fits.
+func gifOverBudget(frames int, canvas int64) string {
+	limits := AppConfig.Decode
+
+	switch {
+	case frames > limits.MaxGifFrames:
+		return "gif_frames"
+	case int64(frames)*canvas > limits.MaxGifPixels:
+		return "gif_pixels"
+	}
+
+	return ""
+}
+
+// scanGif counts the frames of a GIF and returns the area of its canvas. The
+// canvas grows to fit frames that are larger than the logical screen. The
+// decoder refuses such frames, the scan over-counts on purpose so they are
+// budgeted at their real size anyway.
+func scanGif(data []byte) (frames int, canvas int64, err error) {
+	if len(data) < 13 || (string(data[:6]) != "GIF87a" && string(data[:6]) != "GIF89a") {
+		return 0, 0, errInvalidGif
+	}
+
+	width := int(binary.LittleEndian.Uint16(data[6:8]))
+	height := int(binary.LittleEndian.Uint16(data[8:10]))
+	pos := 13
+
+	// Global color table.
+	if flags := data[10]; flags&0x80 != 0 {
+		pos += 3 << (flags&0x07 + 1)
+	}
+
+	// skipSubBlocks moves past a chain of length prefixed data blocks.
+	skipSubBlocks := func() error {
+		for {
+			if pos >= len(data) {
+				return errInvalidGif
+			}
+
+			size := int(data[pos])
+			pos += 1 + size
+
+			if size == 0 {
+				return nil
+			}
+		}
+	}
+
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // Extension
+			pos += 2
+			if err := skipSubBlocks(); err != nil {
+				return 0, 0, err
+			}
+		case 0x2C: // Image descriptor
+			if pos+10 > len(data) {
+				return 0, 0, errInvalidGif
+			}
+
+			left := int(binary.LittleEndian.Uint16(data[pos+1:]))
+			top := int(binary.LittleEndian.Uint16(data[pos+3:]))
+			width = max(width, left+int(binary.LittleEndian.Uint16(data[pos+5:])))
+			height = max(height, top+int(binary.LittleEndian.Uint16(data[pos+7:])))
+			flags := data[pos+9]
+			pos += 10
+
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1)
+			}
+
+			// LZW minimum code size, then the image data.
+			pos++
+			if err := skipSubBlocks(); err != nil {
+				return 0, 0, err
+			}
+
+			frames++
+		case 0x3B: // Trailer
+			return frames, int64(width) * int64(height), nil
+		default:
+			return 0, 0, errInvalidGif
+		}
+	}
+
+	// The decoder refuses GIFs without a trailer too.
+	return 0, 0, errInvalidGif
+}
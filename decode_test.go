@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"testing"
+)
+
+func encodeTestGif(t *testing.T, g *gif.GIF) []byte {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	if err := gif.EncodeAll(buf, g); err != nil {
+		t.Fatalf("encoding: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+// testGif has frames frames of size w×h, every frame with a local palette
+// when local is set.
+func testGif(frames int, w int, h int, local bool) *gif.GIF {
+	g := &gif.GIF{Config: image.Config{Width: w, Height: h}}
+
+	for i := range frames {
+		palette := color.Palette{color.Black, color.White}
+		if local {
+			palette = append(palette, color.RGBA{uint8(i), 0, 0, 255})
+		}
+
+		img := image.NewPaletted(image.Rect(0, 0, w, h), palette)
+		img.Pix[i%len(img.Pix)] = 1
+
+		g.Image = append(g.Image, img)
+		g.Delay = append(g.Delay, 10)
+	}
+
+	if !local {
+		g.Config.ColorModel = color.Palette{color.Black, color.White}
+	}
+
+	return g
+}
+
+func TestScanGifMatchesDecoder(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		frames int
+		w, h   int
+		local  bool
+	}{
+		{"single frame", 1, 16, 16, false},
+		{"global palette", 12, 32, 20, false},
+		{"local palettes", 7, 20, 32, true},
+		{"many frames", 300, 4, 4, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := encodeTestGif(t, testGif(tc.frames, tc.w, tc.h, tc.local))
+
+			frames, canvas, err := scanGif(data)
+			if err != nil {
+				t.Fatalf("scanGif: %v", err)
+			}
+
+			decoded, err := gif.DecodeAll(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("DecodeAll: %v", err)
+			}
+
+			if frames != len(decoded.Image) {
+				t.Errorf("scanGif counted %d frames, the decoder %d", frames, len(decoded.Image))
+			}
+
+			if want := int64(decoded.Config.Width) * int64(decoded.Config.Height); canvas != want {
+				t.Errorf("canvas is %d pixels, want %d", canvas, want)
+			}
+		})
+	}
+}
+
+func TestScanGifCanvasGrowsWithFrames(t *testing.T) {
+	data := encodeTestGif(t, testGif(2, 40, 30, false))
+
+	// Shrink the logical screen below the frames, the canvas has to cover
+	// the frames anyway.
+	binary.LittleEndian.PutUint16(data[6:], 4)
+	binary.LittleEndian.PutUint16(data[8:], 4)
+
+	_, canvas, err := scanGif(data)
+	if err != nil {
+		t.Fatalf("scanGif: %v", err)
+	}
+
+	if canvas != 40*30 {
+		t.Fatalf("canvas is %d pixels, want %d", canvas, 40*30)
+	}
+}
+
+func TestScanGifTruncated(t *testing.T) {
+	data := encodeTestGif(t, testGif(3, 16, 16, true))
+
+	for n := range len(data) {
+		if _, _, err := scanGif(data[:n]); !errors.Is(err, errInvalidGif) {
+			t.Fatalf("first %d of %d bytes: scanGif = %v, want errInvalidGif", n, len(data), err)
+		}
+	}
+
+	if _, _, err := scanGif([]byte("not a GIF at all")); !errors.Is(err, errInvalidGif) {
+		t.Fatalf("scanGif of garbage = %v, want errInvalidGif", err)
+	}
+
+	// An unknown block where the next frame should start.
+	broken := append(bytes.Clone(data[:len(data)-1]), 0x99, 0x3B)
+	if _, _, err := scanGif(broken); !errors.Is(err, errInvalidGif) {
+		t.Fatalf("scanGif with an unknown block = %v, want errInvalidGif", err)
+	}
+}
+
+func TestCheckImageSizeLimits(t *testing.T) {
+	useDefaultConfig(t)
+	AppConfig.Decode.MaxImagePixels = 10_000
+	AppConfig.Decode.MaxGifFrames = 5
+	AppConfig.Decode.MaxGifPixels = 4 * 32 * 32
+
+	var uerr *userError
+
+	check := func(name string, data []byte, wantRefused bool) {
+		t.Helper()
+
+		err := checkImageSize(data)
+		if wantRefused && !errors.As(err, &uerr) {
+			t.Errorf("%s: checkImageSize = %v, want a user error", name, err)
+		}
+		if !wantRefused && err != nil {
+			t.Errorf("%s: checkImageSize = %v, want nil", name, err)
+		}
+	}
+
+	check("small GIF", encodeTestGif(t, testGif(4, 32, 32, false)), false)
+	check("too many frames", encodeTestGif(t, testGif(6, 8, 8, false)), true)
+	check("too many pixels across frames", encodeTestGif(t, testGif(5, 32, 32, false)), true)
+
+	// Frames larger than the logical screen count at their real size.
+	grown := encodeTestGif(t, testGif(2, 90, 90, false))
+	binary.LittleEndian.PutUint16(grown[6:], 8)
+	binary.LittleEndian.PutUint16(grown[8:], 8)
+	check("frames larger than the screen", grown, true)
+
+	// Only the header is read, the huge PNG is never decoded.
+	huge := new(bytes.Buffer)
+	if err := png.Encode(huge, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatalf("encoding PNG: %v", err)
+	}
+	header := huge.Bytes()
+	binary.BigEndian.PutUint32(header[16:], 50_000)
+	binary.BigEndian.PutUint32(header[20:], 50_000)
+	binary.BigEndian.PutUint32(header[29:], crc32.ChecksumIEEE(header[12:29]))
+	check("huge PNG", header, true)
+
+	if err := checkImageSize([]byte("hello")); err == nil {
+		t.Error("checkImageSize accepted something that isn't an image")
+	}
+}
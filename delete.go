@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var errNotOwner = newUserError("That file doesn't exist or wasn't converted by you.")
+
+// keyFromLink turns a link sent by the bot back into the storage key of the
+// file, links to anything else are rejected.
+func keyFromLink(link string) (string, error) {
+	u, err := url.Parse(strings.Trim(strings.TrimSpace(link), "<>"))
+	if err != nil {
+		return "", newUserError("That isn't a valid link.")
+	}
+
+	base, err := url.Parse(AppConfig.Storage.PublicURL)
+	if err != nil || u.Host != base.Host || !strings.HasPrefix(u.Path, base.Path+"/") {
+		return "", newUserError("That isn't a link to a file from this bot.")
+	}
+
+	key := strings.TrimPrefix(path.Clean(strings.TrimPrefix(u.Path, base.Path)), "/")
+	if key == "" || key == "." {
+		return "", newUserError("That isn't a link to a file from this bot.")
+	}
+
+	return key, nil
+}
+
+// deleteConversion deletes a stored file of the user from every storage
+// backend and the CDN cache. The file is kept when other users converted the
+// same file, it is only removed from the user's conversions then. removed
+// reports whether the file itself was deleted. When a mirror still has the
+// file the error wraps ErrMirrorDelete and the conversion is kept, so the
+// user can delete it again.
+func deleteConversion(ctx context.Context, userID string, key string) (removed bool, err error) {
+	owners, err := Conversions.KeyOwners(ctx, key)
+	if err != nil {
+		return false, err
+	}
+
+	if !slices.Contains(owners, userID) {
+		return false, errNotOwner
+	}
+
+	if len(owners) == 1 {
+		mirrorErr := Delete(ctx, path.Dir(key), path.Base(key))
+		if mirrorErr != nil && !errors.Is(mirrorErr, ErrMirrorDelete) {
+			fileDeletions.WithLabelValues("failed").Inc()
+			return false, fmt.Errorf("deleting %s: %w", key, mirrorErr)
+		}
+
+		// The primary copy is gone either way, so the link has to stop working.
+		if err := PurgeBunnyCache(ctx, publicURL(key)); err != nil {
+			slog.Error("[STORAGE] Failed to purge CDN cache", "key", key, "error", err)
+			cdnPurgeFailures.Inc()
+		}
+
+		if mirrorErr != nil {
+			fileDeletions.WithLabelValues("partial").Inc()
+			return false, fmt.Errorf("deleting %s: %w", key, mirrorErr)
+		}
+
+		removed = true
+	}
+
+	if err := Conversions.MarkDeleted(ctx, userID, key); err != nil {
+		return removed, err
+	}
+
+	if removed {
+		slog.Info("[STORAGE] Deleted file", "key", key, "userId", userID)
+		fileDeletions.WithLabelValues("removed").Inc()
+	} else {
+		fileDeletions.WithLabelValues("shared").Inc()
+	}
+
+	return removed, nil
+}
+
+// deleteButton is the button under conversion responses, id is the ID of the
+// conversion in the index.
+func deleteButton(id int64, name string) discordgo.Button {
+	return discordgo.Button{
+		Label:    truncate(strings.TrimSpace("Delete "+name), 80),
+		Style:    discordgo.DangerButton,
+		CustomID: fmt.Sprintf("delete:%d", id),
+	}
+}
+
+// deleteButtonRows lays the buttons out in rows, Discord allows 5 rows of 5.
+func deleteButtonRows(buttons []discordgo.MessageComponent) []discordgo.MessageComponent {
+	var rows []discordgo.MessageComponent
+
+	for len(buttons) > 0 && len(rows) < 5 {
+		n := min(5, len(buttons))
+		rows = append(rows, discordgo.ActionsRow{Components: buttons[:n]})
+		buttons = buttons[n:]
+	}
+
+	return rows
+}
+
+// deleteLink deletes the file behind a link from /delete.
+func deleteLink(userID string, link string) (bool, error) {
+	key, err := keyFromLink(link)
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	return deleteConversion(ctx, userID, key)
+}
+
+// deleteByID deletes the file of a conversion from a delete button.
+func deleteByID(userID string, id string) (bool, error) {
+	conversionID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return false, errNotOwner
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rec, err := Conversions.UserConversion(ctx, userID, conversionID)
+	if errors.Is(err, ErrConversionNotFound) || (err == nil && rec.ObjectKey == "") {
+		return false, errNotOwner
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return deleteConversion(ctx, userID, rec.ObjectKey)
+}
+
+// respondDeleted runs del, which can take a while with slow storage
+// backends, and tells the user how deleting the file went.
+func respondDeleted(s *discordgo.Session, i *discordgo.InteractionCreate, del func() (removed bool, err error)) {
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Flags: discordgo.MessageFlagsEphemeral,
+		},
+	})
+
+	removed, err := del()
+
+	content := "Deleted. The link may keep working for a few minutes until caches expire."
+
+	var uerr *userError
+
+	switch {
+	case errors.As(err, &uerr):
+		content = uerr.msg
+	case errors.Is(err, ErrMirrorDelete):
+		slog.Error("[STORAGE] File left on a mirror", "userId", interactionUser(i).ID, "error", err)
+		content = "The file was deleted, but its backup copy couldn't be removed. Delete it again later to retry."
+	case err != nil:
+		slog.Error("[STORAGE] Failed to delete file", "userId", interactionUser(i).ID, "error", err)
+		content = "Couldn't delete the file, try again later."
+	case !removed:
+		content = "Removed from your conversions. The file stays online because someone else converted the same file."
+	}
+
+	s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+		Content: &content,
+	})
+}
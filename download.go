@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// downloadHosts are the only hosts attachments are downloaded from, so a
+// crafted URL can't make the bot fetch anything else.
+var downloadHosts = map[string]bool{
+	"cdn.discordapp.com":   true,
+	"media.discordapp.net": true,
+}
+
+var errDownloadHost = newUserError("Only files uploaded to Discord can be converted.")
+
+var downloadClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+
+		return checkDownloadURL(req.URL)
+	},
+}
+
+func checkDownloadURL(u *url.URL) error {
+	if u.Scheme != "https" || !downloadHosts[u.Hostname()] || (u.Port() != "" && u.Port() != "443") {
+		return errDownloadHost
+	}
+
+	return nil
+}
+
+// tooLarge is the error for attachments over the download limit.
+func tooLarge() error {
+	return newUserError("The file is larger than the %s limit.", bytesToReadable(AppConfig.Download.MaxBytes()))
+}
+
+// downloadAttachment downloads an attachment from the Discord CDN. The size
+// Discord reports is checked before downloading and the body is cut off at
+// the limit in case it lies. Network errors, 5xx and 429 responses are
+// retried.
+func downloadAttachment(attachment *discordgo.MessageAttachment) ([]byte, error) {
+	return fetchAttachment(attachment, 0)
+}
+
+// downloadHead downloads only the first n bytes of an attachment, enough to
+// sniff its format.
+func downloadHead(attachment *discordgo.MessageAttachment, n int64) ([]byte, error) {
+	return fetchAttachment(attachment, n)
+}
+
+// fetchAttachment downloads the attachment, or its first head bytes when head
+// isn't 0.
+func fetchAttachment(attachment *discordgo.MessageAttachment, head int64) ([]byte, error) {
+	cfg := AppConfig.Download
+
+	u, err := url.Parse(attachment.URL)
+	if err != nil {
+		downloadFailures.WithLabelValues("host").Inc()
+		return nil, fmt.Errorf("failed to parse attachment URL: %w", err)
+	}
+
+	if err := checkDownloadURL(u); err != nil {
+		slog.Warn("[DOWNLOAD] Refusing to download from host", "url", attachment.URL)
+		downloadFailures.WithLabelValues("host").Inc()
+		return nil, err
+	}
+
+	if int64(attachment.Size) > cfg.MaxBytes() {
+		downloadFailures.WithLabelValues("too_large").Inc()
+		return nil, tooLarge()
+	}
+
+	var lastErr error
+
+	for attempt := 0; attempt <= cfg.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(1<<(attempt-1)) * 500 * time.Millisecond)
+			slog.Info("[DOWNLOAD] Retrying download", "url", attachment.URL, "attempt", attempt, "error", lastErr)
+		}
+
+		data, retry, err := download(u.String(), cfg, head)
+		if err == nil {
+			return data, nil
+		}
+
+		lastErr = err
+
+		if !retry {
+			break
+		}
+	}
+
+	return nil, lastErr
+}
+
+// download makes one attempt, retry reports whether the error may go away.
+// A head other than 0 only asks for the first head bytes.
+func download(rawURL string, cfg DownloadConfig, head int64) (data []byte, retry bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if head > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", head-1))
+	}
+
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		if errors.Is(err, errDownloadHost) {
+			downloadFailures.WithLabelValues("host").Inc()
+			return nil, false, errDownloadHost
+		}
+
+		downloadFailures.WithLabelValues("network").Inc()
+		return nil, true, fmt.Errorf("failed to download attachment: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		downloadFailures.WithLabelValues("status").Inc()
+		retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+
+		return nil, retry, fmt.Errorf("failed to download attachment: server returned %s", resp.Status)
+	}
+
+	// Servers may ignore the range and send everything, only the start is read.
+	if head > 0 {
+		data, err = io.ReadAll(io.LimitReader(resp.Body, head))
+		if err != nil {
+			downloadFailures.WithLabelValues("network").Inc()
+			return nil, true, fmt.Errorf("failed to download attachment: %w", err)
+		}
+
+		return data, false, nil
+	}
+
+	if resp.ContentLength > cfg.MaxBytes() {
+		downloadFailures.WithLabelValues("too_large").Inc()
+		return nil, false, tooLarge()
+	}
+
+	// One byte over the limit is enough to know it's too large.
+	data, err = io.ReadAll(io.LimitReader(resp.Body, cfg.MaxBytes()+1))
+	if err != nil {
+		downloadFailures.WithLabelValues("network").Inc()
+		return nil, true, fmt.Errorf("failed to download attachment: %w", err)
+	}
+
+	if int64(len(data)) > cfg.MaxBytes() {
+		downloadFailures.WithLabelValues("too_large").Inc()
+		return nil, false, tooLarge()
+	}
+
+	return data, false, nil
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VideoOptions controls how a video is turned into a GIF.
+type VideoOptions struct {
+	FPS      int
+	Width    int
+	Start    time.Duration
+	Duration time.Duration
+	// End overrides Duration when set, the clip then runs from Start to End.
+	End    time.Duration
+	Dither string
+	// Colors is the size of the generated palette, at most 256.
+	Colors int
+	// Quantizer builds the palette of images, see quantizers.
+	Quantizer string
+	Format    OutputFormat
+	// MaxBytes turns on target-size mode, the GIF is re-encoded with lower
+	// settings until it fits.
+	MaxBytes int64
+	Caption  Caption
+	// Transform is only applied to images, videos are scaled with Width.
+	Transform Transform
+}
+
+const (
+	maxShrinkAttempts = 6
+	minShrinkFPS      = 5
+	minShrinkWidth    = 96
+	minShrinkColors   = 32
+)
+
+// ditherModes maps the dither names users can pick to ffmpeg paletteuse arguments.
+var ditherModes = map[string]string{
+	"bayer":           "dither=bayer:bayer_scale=3",
+	"sierra2_4a":      "dither=sierra2_4a",
+	"floyd_steinberg": "dither=floyd_steinberg",
+	"none":            "dither=none",
+}
+
+func DefaultVideoOptions() VideoOptions {
+	return VideoOptions{
+		FPS:       8,
+		Width:     480,
+		Duration:  10 * time.Second,
+		Dither:    "bayer",
+		Colors:    256,
+		Quantizer: QuantizerPopularity,
+		Format:    FormatGIF,
+		Transform: DefaultTransform(),
+	}
+}
+
+// guildVideoOptions are the default options with the palette settings of the guild.
+func guildVideoOptions(guildID string) VideoOptions {
+	opts := DefaultVideoOptions()
+
+	q := AppConfig.GuildQuantization(guildID)
+	opts.Quantizer, opts.Dither, opts.Colors = q.Quantizer, q.Dither, q.Colors
+
+	return opts
+}
+
+func (o VideoOptions) quantization() Quantization {
+	return Quantization{Quantizer: o.Quantizer, Dither: o.Dither, Colors: o.Colors}
+}
+
+// Validate checks the options against the limits in the conversion config.
+func (o VideoOptions) Validate(limits ConversionConfig) error {
+	if o.FPS < 1 || o.FPS > limits.MaxFPS {
+		return fmt.Errorf("fps has to be between 1 and %d", limits.MaxFPS)
+	}
+
+	if o.Width < 16 || o.Width > limits.MaxWidth {
+		return fmt.Errorf("width has to be between 16 and %d pixels", limits.MaxWidth)
+	}
+
+	if o.Start < 0 {
+		return fmt.Errorf("start can't be negative")
+	}
+
+	if o.End != 0 {
+		if o.End <= o.Start {
+			return fmt.Errorf("end has to be after start")
+		}
+
+		if o.End-o.Start > limits.MaxDuration {
+			return fmt.Errorf("clips can be at most %s long", limits.MaxDuration)
+		}
+	} else if o.Duration <= 0 || o.Duration > limits.MaxDuration {
+		return fmt.Errorf("duration has to be between 0 and %s", limits.MaxDuration)
+	}
+
+	if o.Colors < 4 || o.Colors > 256 {
+		return fmt.Errorf("colors has to be between 4 and 256")
+	}
+
+	if _, ok := ditherModes[o.Dither]; !ok {
+		return fmt.Errorf("unknown dither mode %q", o.Dither)
+	}
+
+	if _, ok := quantizers[o.Quantizer]; !ok {
+		return fmt.Errorf("unknown quantizer %q", o.Quantizer)
+	}
+
+	if _, ok := outputFormats[o.Format.Name]; !ok {
+		return fmt.Errorf("unknown output format %q", o.Format.Name)
+	}
+
+	if err := o.Transform.Validate(limits); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// clip resolves the segment to convert against the length of the video.
+func (o VideoOptions) clip(length time.Duration) (start time.Duration, duration time.Duration, err error) {
+	if o.Start >= length {
+		return 0, 0, newUserError("Start %s is past the end of the video (%s).", formatTimestamp(o.Start), formatTimestamp(length))
+	}
+
+	if o.End != 0 {
+		if o.End > length {
+			return 0, 0, newUserError("End %s is past the end of the video (%s).", formatTimestamp(o.End), formatTimestamp(length))
+		}
+
+		return o.Start, o.End - o.Start, nil
+	}
+
+	return o.Start, min(o.Duration, length-o.Start), nil
+}
+
+// parseTimestamp accepts plain seconds ("83.5") as well as "1:23" and "1:02:03.5".
+func parseTimestamp(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, fmt.Errorf("empty timestamp")
+	}
+
+	parts := strings.Split(value, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", value)
+	}
+
+	var seconds float64
+
+	for i, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid timestamp %q", value)
+		}
+
+		if i < len(parts)-1 && n != float64(int(n)) {
+			return 0, fmt.Errorf("invalid timestamp %q", value)
+		}
+
+		if i > 0 && n >= 60 {
+			return 0, fmt.Errorf("invalid timestamp %q", value)
+		}
+
+		seconds = seconds*60 + n
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+func formatTimestamp(d time.Duration) string {
+	minutes := int(d / time.Minute)
+	seconds := (d % time.Minute).Seconds()
+
+	if seconds == float64(int(seconds)) {
+		return fmt.Sprintf("%d:%02d", minutes, int(seconds))
+	}
+
+	return fmt.Sprintf("%d:%04.1f", minutes, seconds)
+}
+
+func ffmpegSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+func ffmpegPath() string {
+	if isRunningInDocker() {
+		return "ffmpeg"
+	}
+
+	return "bin/ffmpeg-win/ffmpeg.exe"
+}
+
+func ffprobePath() string {
+	if isRunningInDocker() {
+		return "ffprobe"
+	}
+
+	return "bin/ffmpeg-win/ffprobe.exe"
+}
+
+// encodeVideoSource converts the downloaded video, ffmpeg reads it from a
+// temp file with the extension of its format.
+func encodeVideoSource(media Media, source []byte, opts VideoOptions) (*Converted, error) {
+	tmpIn, err := os.CreateTemp("", "input-*"+media.Ext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp input file: %w", err)
+	}
+	defer os.Remove(tmpIn.Name())
+
+	_, err = tmpIn.Write(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write to temp input file: %w", err)
+	}
+
+	tmpIn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), AppConfig.FFmpeg.Timeout)
+	defer cancel()
+
+	info, err := probeVideo(ctx, tmpIn.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := info.check(); err != nil {
+		return nil, err
+	}
+
+	opts = info.adapt(opts)
+
+	start, duration, err := opts.clip(info.Duration)
+	if err != nil {
+		return nil, err
+	}
+
+	var overlay string
+
+	if !opts.Caption.Empty() {
+		overlay, err = writeCaptionOverlay(info, opts)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(overlay)
+	}
+
+	for attempt := 0; ; attempt++ {
+		out, err := encodeVideo(ctx, tmpIn.Name(), overlay, start, duration, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		if opts.MaxBytes == 0 {
+			return &Converted{Data: bytes.NewBuffer(out), Format: opts.Format}, nil
+		}
+
+		size := int64(len(out))
+
+		if size <= opts.MaxBytes {
+			note := fmt.Sprintf("%d fps, %dpx, %s", opts.FPS, opts.Width, bytesToReadable(size))
+			if opts.Format == FormatGIF {
+				note = fmt.Sprintf("%d fps, %dpx, %d colors, %s", opts.FPS, opts.Width, opts.Colors, bytesToReadable(size))
+			}
+
+			return &Converted{Data: bytes.NewBuffer(out), Format: opts.Format, Note: note}, nil
+		}
+
+		shrunk := opts.shrink(float64(opts.MaxBytes) / float64(size))
+
+		if attempt == maxShrinkAttempts || shrunk == opts {
+			return nil, newUserError("Couldn't get the file under %s, try a shorter clip.", bytesToReadable(opts.MaxBytes))
+		}
+
+		slog.Info("[FFMPEG] Output too large, shrinking", "size", size, "max", opts.MaxBytes, "fps", shrunk.FPS, "width", shrunk.Width, "colors", shrunk.Colors)
+
+		opts = shrunk
+	}
+}
+
+// shrink lowers the frame rate, width and palette size for another attempt.
+// ratio is the wanted size divided by the size of the last attempt.
+func (o VideoOptions) shrink(ratio float64) VideoOptions {
+	// The size scales roughly with frames times pixels, so split the
+	// reduction between the frame rate and the area.
+	step := math.Max(0.5, math.Min(0.9, math.Sqrt(ratio)))
+
+	o.FPS = max(min(o.FPS, minShrinkFPS), int(float64(o.FPS)*step))
+	o.Width = max(min(o.Width, minShrinkWidth), int(float64(o.Width)*math.Sqrt(step)))
+
+	if ratio < 0.8 {
+		o.Colors = max(min(o.Colors, minShrinkColors), o.Colors/2)
+	}
+
+	return o
+}
+
+// writeCaptionOverlay renders the caption at the output size of the video to
+// a temporary PNG and returns its path.
+func writeCaptionOverlay(info VideoInfo, opts VideoOptions) (string, error) {
+	width, height := info.DisplaySize()
+
+	overlay, err := captionOverlay(opts.Width, max(1, opts.Width*height/width), opts.Caption)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp("", "caption-*.png")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp caption file: %w", err)
+	}
+	defer tmp.Close()
+
+	if err := png.Encode(tmp, overlay); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to encode caption overlay: %w", err)
+	}
+
+	return tmp.Name(), nil
+}
+
+// videoFilters builds the filter graph that scales the video and, when there
+// is a caption overlay at input overlayInput, draws it over every frame. The
+// output is labeled [v].
+func videoFilters(opts VideoOptions, overlay string, overlayInput int) string {
+	graph := fmt.Sprintf("[0:v]fps=%d,scale=%d:-1:flags=lanczos", opts.FPS, opts.Width)
+
+	if overlay == "" {
+		return graph + "[v]"
+	}
+
+	// The overlay is rendered at the first width we try, scale2ref keeps it
+	// matching when target-size mode shrinks the video.
+	return graph + fmt.Sprintf("[base];[%d:v][base]scale2ref=flags=lanczos[caption][base];[base][caption]overlay=0:0:shortest=1[v]", overlayInput)
+}
+
+// overlayArgs are the input arguments for the caption overlay, if any.
+func overlayArgs(overlay string) []string {
+	if overlay == "" {
+		return nil
+	}
+
+	return []string{"-loop", "1", "-i", overlay}
+}
+
+// encodeVideo converts the segment of the video at input to opts.Format.
+// overlay is the path of a caption overlay or empty.
+func encodeVideo(ctx context.Context, input string, overlay string, start time.Duration, duration time.Duration, opts VideoOptions) ([]byte, error) {
+	if opts.Format == FormatGIF {
+		return encodeVideoToGif(ctx, input, overlay, start, duration, opts)
+	}
+
+	args := []string{
+		"-ss", ffmpegSeconds(start),
+		"-t", ffmpegSeconds(duration),
+		"-i", input,
+	}
+	args = append(args, overlayArgs(overlay)...)
+	args = append(args,
+		"-filter_complex", videoFilters(opts, overlay, 1),
+		"-map", "[v]",
+		"-an",
+	)
+
+	return encodeAnimatedFormat(ctx, args, opts.Format)
+}
+
+// encodeAnimatedFormat runs ffmpeg with the input arguments args and encodes
+// the result as an animated WebP or APNG.
+func encodeAnimatedFormat(ctx context.Context, args []string, format OutputFormat) ([]byte, error) {
+	switch format {
+	case FormatWebP:
+		args = append(args, "-c:v", "libwebp", "-lossless", "0", "-quality", "75", "-compression_level", "4", "-loop", "0", "-f", "webp")
+	case FormatAPNG:
+		args = append(args, "-c:v", "apng", "-pred", "mixed", "-plays", "0", "-f", "apng")
+	default:
+		return nil, fmt.Errorf("unsupported output format %q", format.Name)
+	}
+
+	// Both muxers seek back to fix up headers, so they can't write to a pipe.
+	tmpOut, err := os.CreateTemp("", "output-*"+format.Ext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp output file: %w", err)
+	}
+	defer os.Remove(tmpOut.Name())
+	tmpOut.Close()
+
+	args = append(args, "-y", tmpOut.Name())
+
+	var stderr bytes.Buffer
+
+	if err := runFFmpeg(ctx, ffmpegPath(), args, nil, nil, &stderr); err != nil {
+		return nil, ffmpegError("ffmpeg error", err, &stderr)
+	}
+
+	outBytes, err := os.ReadFile(tmpOut.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read output file: %w", err)
+	}
+
+	return outBytes, nil
+}
+
+// encodeAnimation converts an animated GIF to an animated WebP or APNG with
+// the same frames and timing.
+func encodeAnimation(data []byte, format OutputFormat) ([]byte, error) {
+	tmpIn, err := os.CreateTemp("", "input-*.gif")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp input file: %w", err)
+	}
+	defer os.Remove(tmpIn.Name())
+
+	_, err = tmpIn.Write(data)
+	tmpIn.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to write to temp input file: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), AppConfig.FFmpeg.Timeout)
+	defer cancel()
+
+	return encodeAnimatedFormat(ctx, []string{"-i", tmpIn.Name(), "-an"}, format)
+}
+
+// decodeWithFFmpeg decodes images the Go decoders can't read, like AVIF and
+// HEIC, by letting ffmpeg convert the first frame to PNG.
+func decodeWithFFmpeg(source []byte, media Media) (image.Image, error) {
+	tmpIn, err := os.CreateTemp("", "input-*"+media.Ext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp input file: %w", err)
+	}
+	defer os.Remove(tmpIn.Name())
+
+	_, err = tmpIn.Write(source)
+	tmpIn.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to write to temp input file: %w", err)
+	}
+
+	args := []string{
+		"-i", tmpIn.Name(),
+		"-frames:v", "1",
+		"-c:v", "png",
+		"-f", "image2pipe",
+		"pipe:1",
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), AppConfig.FFmpeg.Timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+
+	err = runFFmpeg(ctx, ffmpegPath(), args, nil, &stdout, &stderr)
+	if errors.Is(err, errConversionTimedOut) {
+		return nil, err
+	}
+	if err != nil {
+		slog.Warn("[FFMPEG] Failed to decode image", "format", media.Name, "error", err, "stderr", stderr.String())
+		return nil, newUserError("Couldn't read this %s image.", media.Name)
+	}
+
+	if err := checkImageSize(stdout.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return png.Decode(&stdout)
+}
+
+// ffmpegError adds the output of ffmpeg to err, timeouts are passed on as is
+// so they reach the user.
+func ffmpegError(msg string, err error, stderr *bytes.Buffer) error {
+	if errors.Is(err, errConversionTimedOut) {
+		return err
+	}
+
+	return fmt.Errorf("%s: %v\n%s", msg, err, stderr.String())
+}
+
+// encodeWebPStill turns a single image into a lossy still WebP, the standard
+// library has no WebP encoder.
+func encodeWebPStill(img image.Image) ([]byte, error) {
+	var in bytes.Buffer
+	if err := png.Encode(&in, img); err != nil {
+		return nil, fmt.Errorf("failed to encode PNG: %w", err)
+	}
+
+	args := []string{
+		"-f", "png_pipe",
+		"-i", "pipe:0",
+		"-c:v", "libwebp",
+		"-quality", "85",
+		"-f", "webp",
+		"pipe:1",
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), AppConfig.FFmpeg.Timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+
+	if err := runFFmpeg(ctx, ffmpegPath(), args, &in, &stdout, &stderr); err != nil {
+		return nil, ffmpegError("ffmpeg error", err, &stderr)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// encodeVideoToGif runs the two pass palettegen/paletteuse conversion and
+// returns the GIF.
+func encodeVideoToGif(ctx context.Context, input string, overlay string, start time.Duration, duration time.Duration, opts VideoOptions) ([]byte, error) {
+	tmpOut, err := os.CreateTemp("", "output-*.gif")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp output file: %w", err)
+	}
+	defer os.Remove(tmpOut.Name())
+	tmpOut.Close()
+
+	tmpPalette, err := os.CreateTemp("", "palette-*.png")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp palette file: %w", err)
+	}
+	defer os.Remove(tmpPalette.Name())
+
+	palettegen := fmt.Sprintf("palettegen=max_colors=%d", opts.Colors)
+
+	args1 := []string{
+		"-ss", ffmpegSeconds(start),
+		"-t", ffmpegSeconds(duration),
+		"-i", input,
+	}
+	args1 = append(args1, overlayArgs(overlay)...)
+	args1 = append(args1,
+		"-filter_complex", videoFilters(opts, overlay, 1)+";[v]"+palettegen+"[p]",
+		"-map", "[p]",
+		"-y",
+		tmpPalette.Name(),
+	)
+
+	var stderr1 bytes.Buffer
+
+	if err := runFFmpeg(ctx, ffmpegPath(), args1, nil, nil, &stderr1); err != nil {
+		return nil, ffmpegError("failed to generate palette", err, &stderr1)
+	}
+
+	args2 := []string{
+		"-ss", ffmpegSeconds(start),
+		"-t", ffmpegSeconds(duration),
+		"-i", input,
+		"-i", tmpPalette.Name(),
+	}
+	args2 = append(args2, overlayArgs(overlay)...)
+	args2 = append(args2,
+		"-filter_complex", fmt.Sprintf("%s;[v][1:v]paletteuse=%s[out]", videoFilters(opts, overlay, 2), ditherModes[opts.Dither]),
+		"-map", "[out]",
+		"-y",
+		tmpOut.Name(),
+	)
+
+	var stderr2 bytes.Buffer
+
+	if err := runFFmpeg(ctx, ffmpegPath(), args2, nil, nil, &stderr2); err != nil {
+		return nil, ffmpegError("ffmpeg error", err, &stderr2)
+	}
+
+	outBytes, err := os.ReadFile(tmpOut.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read output file: %w", err)
+	}
+
+	return optimizeEncodedGif(outBytes, "video"), nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+func init() {
+	// Alpine images ship without /etc/mime.types, make sure the formats we
+	// produce always get the right Content-Type.
+	mime.AddExtensionType(".gif", "image/gif")
+	mime.AddExtensionType(".png", "image/png")
+	mime.AddExtensionType(".webp", "image/webp")
+}
+
+// fileHandler serves files out of a LocalStorage root. Directory listings are
+// never served and http.ServeContent takes care of ranges and conditional
+// requests.
+type fileHandler struct {
+	root *os.Root
+}
+
+func (h *fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" || strings.HasPrefix(path.Base(name), ".") {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := h.root.Open(name)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("[FILES] Failed to open file", "name", name, "error", err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size()))
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+// StartFileServer serves the local storage directory so the bot can run
+// without a CDN in front of it.
+func StartFileServer(root string, addr string) {
+	dir, err := os.OpenRoot(root)
+	if err != nil {
+		slog.Error("[FILES] Failed to open storage directory", "root", root, "error", err)
+		return
+	}
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           &fileHandler{root: dir},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	slog.Info("[FILES] Starting file server", "addr", addr, "root", root)
+	if err := server.ListenAndServe(); err != nil {
+		slog.Error("[FILES] Failed to start HTTP server", "error", err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/png"
+
+	_ "golang.org/x/image/webp"
+)
+
+// OutputFormat describes a file type we can produce and where it's stored.
+type OutputFormat struct {
+	Name        string
+	Ext         string
+	ContentType string
+	// Dir is the storage directory files of this format are uploaded to.
+	Dir string
+}
+
+var (
+	FormatGIF  = OutputFormat{Name: "gif", Ext: ".gif", ContentType: "image/gif", Dir: "gifs"}
+	FormatWebP = OutputFormat{Name: "webp", Ext: ".webp", ContentType: "image/webp", Dir: "webp"}
+	FormatAPNG = OutputFormat{Name: "apng", Ext: ".png", ContentType: "image/apng", Dir: "apng"}
+	// FormatPNG is what an APNG request turns into for a single still image.
+	FormatPNG = OutputFormat{Name: "png", Ext: ".png", ContentType: "image/png", Dir: "png"}
+)
+
+// outputFormats are the formats users can ask for.
+var outputFormats = map[string]OutputFormat{
+	FormatGIF.Name:  FormatGIF,
+	FormatWebP.Name: FormatWebP,
+	FormatAPNG.Name: FormatAPNG,
+}
+
+// encodeStill encodes a single image. Animated formats make no sense for one
+// frame, so APNG becomes a plain PNG and WebP a still WebP.
+func encodeStill(img image.Image, format OutputFormat, q Quantization) (*Converted, error) {
+	buf := new(bytes.Buffer)
+
+	switch format {
+	case FormatGIF:
+		gifImage := quantizeFrames([]image.Image{img}, 0, uint8(AppConfig.Conversion.AlphaThreshold), q)
+
+		if err := gif.EncodeAll(buf, gifImage); err != nil {
+			fmt.Println("Error encoding GIF:", err)
+			return nil, err
+		}
+	case FormatAPNG, FormatPNG:
+		if err := png.Encode(buf, img); err != nil {
+			return nil, fmt.Errorf("failed to encode PNG: %w", err)
+		}
+
+		format = FormatPNG
+	case FormatWebP:
+		out, err := encodeWebPStill(img)
+		if err != nil {
+			return nil, err
+		}
+
+		buf = bytes.NewBuffer(out)
+	default:
+		return nil, fmt.Errorf("unsupported output format %q", format.Name)
+	}
+
+	return &Converted{Data: buf, Format: format}, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// galleryPageSize is how many conversions one /mygifs page shows, every one
+// of them gets an embed with a preview.
+const galleryPageSize = 5
+
+func truncate(s string, length int) string {
+	runes := []rune(s)
+	if len(runes) <= length {
+		return s
+	}
+
+	return string(runes[:length-1]) + "…"
+}
+
+func conversionEmbed(rec ConversionRecord) *discordgo.MessageEmbed {
+	link := publicURL(rec.ObjectKey)
+
+	return &discordgo.MessageEmbed{
+		Title:       truncate(rec.SourceName, 256),
+		URL:         link,
+		Description: fmt.Sprintf("**%s** · %s\n%s", strings.ToUpper(rec.Format), bytesToReadable(rec.OutputSize), link),
+		Timestamp:   rec.CreatedAt.Format(time.RFC3339),
+		// Every stored format is an image Discord can preview.
+		Image: &discordgo.MessageEmbedImage{URL: link},
+	}
+}
+
+// galleryPage lists one page of the user's conversions with buttons to move
+// between pages and a menu to pick a single conversion.
+func galleryPage(userID string, page int) (*discordgo.InteractionResponseData, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	records, total, err := Conversions.UserConversions(ctx, userID, page*galleryPageSize, galleryPageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	pages := max(1, (total+galleryPageSize-1)/galleryPageSize)
+
+	// Conversions may have been deleted since the buttons were sent.
+	if len(records) == 0 && total > 0 {
+		page = pages - 1
+
+		records, total, err = Conversions.UserConversions(ctx, userID, page*galleryPageSize, galleryPageSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if total == 0 {
+		return &discordgo.InteractionResponseData{
+			Flags:      discordgo.MessageFlagsEphemeral,
+			Content:    "You don't have any stored conversions yet. Files sent as attachments aren't stored, so they don't show up here.",
+			Embeds:     []*discordgo.MessageEmbed{},
+			Components: []discordgo.MessageComponent{},
+		}, nil
+	}
+
+	embeds := make([]*discordgo.MessageEmbed, 0, len(records))
+	options := make([]discordgo.SelectMenuOption, 0, len(records))
+
+	for n, rec := range records {
+		embeds = append(embeds, conversionEmbed(rec))
+		options = append(options, discordgo.SelectMenuOption{
+			Label:       truncate(fmt.Sprintf("%d. %s", page*galleryPageSize+n+1, rec.SourceName), 100),
+			Description: fmt.Sprintf("%s · %s · %s", strings.ToUpper(rec.Format), bytesToReadable(rec.OutputSize), rec.CreatedAt.UTC().Format("2006-01-02 15:04")),
+			Value:       strconv.FormatInt(rec.ID, 10),
+		})
+	}
+
+	return &discordgo.InteractionResponseData{
+		Flags:   discordgo.MessageFlagsEphemeral,
+		Content: fmt.Sprintf("Your conversions (%d):", total),
+		Embeds:  embeds,
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{
+				Components: []discordgo.MessageComponent{
+					discordgo.SelectMenu{
+						CustomID:    fmt.Sprintf("mygifs:select:%d", page),
+						Placeholder: "Show a single conversion",
+						Options:     options,
+					},
+				},
+			},
+			discordgo.ActionsRow{
+				Components: []discordgo.MessageComponent{
+					discordgo.Button{
+						Label:    "Previous",
+						Style:    discordgo.SecondaryButton,
+						CustomID: fmt.Sprintf("mygifs:page:%d", page-1),
+						Disabled: page == 0,
+					},
+					discordgo.Button{
+						Label:    fmt.Sprintf("Page %d/%d", page+1, pages),
+						Style:    discordgo.SecondaryButton,
+						CustomID: "mygifs:current",
+						Disabled: true,
+					},
+					discordgo.Button{
+						Label:    "Next",
+						Style:    discordgo.SecondaryButton,
+						CustomID: fmt.Sprintf("mygifs:page:%d", page+1),
+						Disabled: page >= pages-1,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// galleryEntry shows a single conversion with a button back to the page it
+// was picked from.
+func galleryEntry(userID string, id int64, page int) (*discordgo.InteractionResponseData, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rec, err := Conversions.UserConversion(ctx, userID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	embed := conversionEmbed(rec)
+	embed.Fields = []*discordgo.MessageEmbedField{
+		{Name: "Source size", Value: bytesToReadable(rec.SourceSize), Inline: true},
+		{Name: "Output size", Value: bytesToReadable(rec.OutputSize), Inline: true},
+	}
+
+	return &discordgo.InteractionResponseData{
+		Content: "",
+		Embeds:  []*discordgo.MessageEmbed{embed},
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{
+				Components: []discordgo.MessageComponent{
+					discordgo.Button{
+						Label:    "Back",
+						Style:    discordgo.SecondaryButton,
+						CustomID: fmt.Sprintf("mygifs:page:%d", page),
+					},
+					discordgo.Button{
+						Label: "Open",
+						Style: discordgo.LinkButton,
+						URL:   publicURL(rec.ObjectKey),
+					},
+					deleteButton(rec.ID, ""),
+				},
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"math"
+	"slices"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	minGifSpeed = 0.1
+	maxGifSpeed = 10
+	// minGifDelay is the shortest delay browsers honor, in 100ths of a
+	// second. Shorter delays get slowed down to 10 instead.
+	minGifDelay = 2
+)
+
+// GifEdit lists the edits /editgif applies, in the order they're applied.
+type GifEdit struct {
+	Transform Transform
+	Reverse   bool
+	Boomerang bool
+	// Speed multiplies the playback speed, 1 keeps it as is.
+	Speed float64
+	// Loops is how many times the GIF plays, 0 loops forever and -1 keeps
+	// the loop count of the original.
+	Loops int
+}
+
+func DefaultGifEdit() GifEdit {
+	return GifEdit{Speed: 1, Loops: -1, Transform: DefaultTransform()}
+}
+
+func (e GifEdit) Validate(limits ConversionConfig) error {
+	if e.Speed < minGifSpeed || e.Speed > maxGifSpeed {
+		return fmt.Errorf("speed has to be between %g and %g", minGifSpeed, float64(maxGifSpeed))
+	}
+
+	if err := e.Transform.Validate(limits); err != nil {
+		return err
+	}
+
+	if e == DefaultGifEdit() {
+		return fmt.Errorf("pick at least one edit")
+	}
+
+	return nil
+}
+
+// coalesceGif renders every frame of g onto the full canvas, applying the
+// disposal of the frames before it, so frames can be reordered or
+// transformed on their own.
+func coalesceGif(g *gif.GIF) []*image.RGBA {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+
+	if bounds.Empty() {
+		for _, frame := range g.Image {
+			bounds = bounds.Union(frame.Bounds())
+		}
+	}
+
+	canvas := image.NewRGBA(bounds)
+	frames := make([]*image.RGBA, len(g.Image))
+
+	for i, frame := range g.Image {
+		disposal := byte(gif.DisposalNone)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = cloneRGBA(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		frames[i] = cloneRGBA(canvas)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	return frames
+}
+
+func cloneRGBA(img *image.RGBA) *image.RGBA {
+	clone := image.NewRGBA(img.Rect)
+	copy(clone.Pix, img.Pix)
+
+	return clone
+}
+
+// encodeFrames quantizes full canvas frames back into a GIF.
+func encodeFrames(frames []*image.RGBA, delays []int, loopCount int, q Quantization) *gif.GIF {
+	images := make([]image.Image, len(frames))
+	for i, frame := range frames {
+		images[i] = frame
+	}
+
+	g := quantizeFrames(images, 0, uint8(AppConfig.Conversion.AlphaThreshold), q)
+	g.Delay = delays
+	g.LoopCount = loopCount
+
+	return g
+}
+
+// gifDelays returns the delays of g the way browsers play them.
+func gifDelays(g *gif.GIF) []int {
+	delays := make([]int, len(g.Image))
+
+	for i := range delays {
+		delays[i] = 10
+
+		if i < len(g.Delay) && g.Delay[i] >= minGifDelay {
+			delays[i] = g.Delay[i]
+		}
+	}
+
+	return delays
+}
+
+// changeSpeed rescales the delays. Frames that would get shorter than
+// browsers allow are dropped and their time is added to the next frame.
+func changeSpeed(frames []*image.RGBA, delays []int, speed float64) ([]*image.RGBA, []int) {
+	var outFrames []*image.RGBA
+	var outDelays []int
+	carry := 0.0
+
+	for i, frame := range frames {
+		delay := float64(delays[i])/speed + carry
+
+		if delay < minGifDelay && i < len(frames)-1 {
+			carry = delay
+			continue
+		}
+
+		rounded := max(minGifDelay, int(math.Round(delay)))
+		carry = delay - float64(rounded)
+
+		outFrames = append(outFrames, frame)
+		outDelays = append(outDelays, rounded)
+	}
+
+	return outFrames, outDelays
+}
+
+// editGif applies the edits to a decoded GIF. q is only used when the edits
+// leave more colors than fit in the palette, eg. after resizing.
+func editGif(g *gif.GIF, edit GifEdit, q Quantization) (*gif.GIF, error) {
+	frames := coalesceGif(g)
+	delays := gifDelays(g)
+
+	if !edit.Transform.Empty() {
+		// Boomerang repeats the frames, they are all quantized separately.
+		count := len(frames)
+		if edit.Boomerang && count > 2 {
+			count = 2*count - 2
+		}
+
+		if err := edit.Transform.CheckSize(frames[0].Rect, count); err != nil {
+			return nil, err
+		}
+
+		for i, frame := range frames {
+			transformed, err := edit.Transform.Apply(frame)
+			if err != nil {
+				return nil, err
+			}
+			frames[i] = transformed
+		}
+	}
+
+	if edit.Reverse {
+		slices.Reverse(frames)
+		slices.Reverse(delays)
+	}
+
+	if edit.Boomerang && len(frames) > 2 {
+		for i := len(frames) - 2; i > 0; i-- {
+			frames = append(frames, frames[i])
+			delays = append(delays, delays[i])
+		}
+	}
+
+	if edit.Speed != 1 {
+		frames, delays = changeSpeed(frames, delays, edit.Speed)
+	}
+
+	loopCount := g.LoopCount
+
+	switch {
+	case edit.Loops == 0:
+		loopCount = 0
+	case edit.Loops == 1:
+		loopCount = -1
+	case edit.Loops > 1:
+		// LoopCount counts repeats after the first play.
+		loopCount = edit.Loops - 1
+	}
+
+	return encodeFrames(frames, delays, loopCount, q), nil
+}
+
+func editGifSource(attachment *discordgo.MessageAttachment, source []byte, edit GifEdit, q Quantization) (*bytes.Buffer, error) {
+	g, err := decodeGif(source)
+	if err != nil {
+		var uerr *userError
+		if errors.As(err, &uerr) {
+			return nil, err
+		}
+
+		return nil, newUserError("Couldn't read %s as a GIF.", attachment.Filename)
+	}
+
+	edited, err := editGif(g, edit, q)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := smallestEncoding(edited, nil, "edit")
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewBuffer(out), nil
+}
@@ -2,32 +2,24 @@ package main
 
 import (
 	"bytes"
-	"context"
+	"errors"
 	"fmt"
 	"image"
 
+	"image/draw"
 	"image/gif"
-	"io"
 	"log"
 	"log/slog"
 	"mehf/pngtogifbot/translations"
-	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bwmarrin/discordgo"
-	"github.com/gary23b/easygif"
-	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 	"github.com/shirou/gopsutil/v3/load"
 	Reporter "github.com/valeriansaliou/go-vigil-reporter/vigil_reporter"
@@ -35,47 +27,89 @@ import (
 
 var startTime time.Time
 
-var S3Client *s3.Client
-
 func main() {
 	startTime = time.Now()
 	godotenv.Load()
 
-	if isRunningInDocker() {
-		builder := Reporter.New(os.Getenv("VIGIL_REPORTER_URL"), os.Getenv("VIGIL_REPORTER_TOKEN"))
-		reporter := builder.ProbeID("png2gif").NodeID("png2gif-bot").ReplicaID(fmt.Sprintf("%s-%s", os.Getenv("BUNNYNET_MC_REGION"), os.Getenv("BUNNYNET_MC_PODID"))).Interval(time.Duration(30 * time.Second)).Build()
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+
+	AppConfig = cfg
+
+	if isRunningInDocker() && cfg.Vigil.URL != "" {
+		builder := Reporter.New(cfg.Vigil.URL, cfg.Vigil.Token)
+		reporter := builder.ProbeID("png2gif").NodeID("png2gif-bot").ReplicaID(fmt.Sprintf("%s-%s", cfg.Instance.Region, cfg.Instance.PodID)).Interval(time.Duration(30 * time.Second)).Build()
 		reporter.Run()
 	}
 
-	go StartPrometheusHTTPHandler()
+	go StartPrometheusHTTPHandler(cfg.Metrics.Addr)
 
-	accessKey := os.Getenv("S3_ACCESS_KEY_ID")
-	secretKey := os.Getenv("S3_SECRET_ACCESS_KEY")
+	if err := SetupStorage(cfg); err != nil {
+		log.Fatalf("failed to set up storage: %v", err)
+	}
 
-	const (
-		region   = "nl-ams"
-		endpoint = "https://s3.nl-ams.scw.cloud"
-		bucket   = "png2gif-files"
-	)
+	SetupQueues(cfg)
 
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithRegion(region),
-		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(accessKey, secretKey, "")),
-	)
+	Conversions, err = OpenConversionIndex(cfg.Database.Path)
 	if err != nil {
-		log.Fatalf("failed to load AWS config: %v", err)
-	}
-
-	S3Client = s3.New(s3.Options{
-		Credentials: cfg.Credentials,
-		Region:      region,
-		EndpointResolver: s3.EndpointResolverFunc(func(region string, options s3.EndpointResolverOptions) (aws.Endpoint, error) {
-			return aws.Endpoint{
-				URL:           endpoint,
-				SigningRegion: region,
-			}, nil
-		}),
-	})
+		log.Fatalf("failed to open database: %v", err)
+	}
+	defer Conversions.Close()
+
+	minFPS, minWidth, minDuration, minMaxSize := 1.0, 16.0, 0.1, 0.5
+	minSpeed, minLoops, minColors := minGifSpeed, 0.0, 4.0
+
+	transformOptions := []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "crop",
+			Description: "Area to keep as WIDTHxHEIGHT+X+Y, eg. 200x100+10+20 (images and GIFs)",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "aspect",
+			Description: "Crop the center to an aspect ratio (images and GIFs)",
+			Choices: []*discordgo.ApplicationCommandOptionChoice{
+				{Name: "Square (1:1)", Value: "1:1"},
+				{Name: "4:3", Value: "4:3"},
+				{Name: "3:4", Value: "3:4"},
+				{Name: "16:9", Value: "16:9"},
+				{Name: "9:16", Value: "9:16"},
+			},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionInteger,
+			Name:        "rotate",
+			Description: "Rotate clockwise (images and GIFs)",
+			Choices: []*discordgo.ApplicationCommandOptionChoice{
+				{Name: "90°", Value: 90},
+				{Name: "180°", Value: 180},
+				{Name: "270°", Value: 270},
+			},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "flip",
+			Description: "Mirror the image (images and GIFs)",
+			Choices: []*discordgo.ApplicationCommandOptionChoice{
+				{Name: "Horizontally", Value: "horizontal"},
+				{Name: "Vertically", Value: "vertical"},
+				{Name: "Both", Value: "both"},
+			},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "filter",
+			Description: "Filter used when resizing (images and GIFs)",
+			Choices: []*discordgo.ApplicationCommandOptionChoice{
+				{Name: "Catmull-Rom (default)", Value: "catmullrom"},
+				{Name: "Bilinear", Value: "bilinear"},
+				{Name: "Nearest neighbor (pixel art)", Value: "nearest"},
+			},
+		},
+	}
 
 	commands := []*discordgo.ApplicationCommand{
 		{
@@ -87,200 +121,384 @@ func main() {
 			Name: "Transform files to GIFs",
 			Type: 3,
 		},
+		{
+			Name: "Clip video to GIF",
+			Type: 3,
+		},
+		{
+			Name: "Combine images into GIF",
+			Type: 3,
+		},
+		{
+			Name: "Caption as GIF",
+			Type: 3,
+		},
 		{
 			Name:        "stats",
 			Description: "Statistics of png2gif bot",
 		},
+		{
+			Name:        "mygifs",
+			Description: "Browse the files you converted",
+		},
+		{
+			Name:        "delete",
+			Description: "Delete a file you converted",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "link",
+					Description: "Link to the file",
+					Required:    true,
+				},
+			},
+		},
+		{
+			Name:        "gif",
+			Description: "Convert an image or video to a GIF",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionAttachment,
+					Name:        "file",
+					Description: "Image or video to convert",
+					Required:    true,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "fps",
+					Description: "Frames per second of the GIF (videos only)",
+					MinValue:    &minFPS,
+					MaxValue:    float64(cfg.Conversion.MaxFPS),
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "width",
+					Description: "Width of the GIF in pixels",
+					MinValue:    &minWidth,
+					MaxValue:    float64(cfg.Conversion.MaxWidth),
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "start",
+					Description: "Where to start in the video, eg. 1:23 or 83.5",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "end",
+					Description: "Where to stop in the video, eg. 1:29 (instead of duration)",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionNumber,
+					Name:        "duration",
+					Description: "How many seconds of the video to convert",
+					MinValue:    &minDuration,
+					MaxValue:    cfg.Conversion.MaxDuration.Seconds(),
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "dither",
+					Description: "Dithering used when reducing colors",
+					Choices: []*discordgo.ApplicationCommandOptionChoice{
+						{Name: "Bayer", Value: "bayer"},
+						{Name: "Sierra", Value: "sierra2_4a"},
+						{Name: "Floyd-Steinberg", Value: "floyd_steinberg"},
+						{Name: "None", Value: "none"},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "quantizer",
+					Description: "How the palette of images is picked",
+					Choices: []*discordgo.ApplicationCommandOptionChoice{
+						{Name: "Most used colors", Value: QuantizerPopularity},
+						{Name: "Median cut", Value: QuantizerMedianCut},
+						{Name: "Octree", Value: QuantizerOctree},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "colors",
+					Description: "Palette size of the GIF",
+					MinValue:    &minColors,
+					MaxValue:    256,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "format",
+					Description: "Output format, WebP and APNG keep more colors than GIF",
+					Choices: []*discordgo.ApplicationCommandOptionChoice{
+						{Name: "GIF (default)", Value: FormatGIF.Name},
+						{Name: "Animated WebP", Value: FormatWebP.Name},
+						{Name: "APNG", Value: FormatAPNG.Name},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "fit",
+					Description: "Shrink the GIF until it fits this server's upload limit (videos only)",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionNumber,
+					Name:        "max_size",
+					Description: "Shrink the GIF until it's at most this many MB (videos only)",
+					MinValue:    &minMaxSize,
+					MaxValue:    100,
+				},
+				transformOptions[0],
+				transformOptions[1],
+				transformOptions[2],
+				transformOptions[3],
+				transformOptions[4],
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "top_text",
+					Description: "Caption drawn at the top of every frame",
+					MaxLength:   maxCaptionRunes,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "bottom_text",
+					Description: "Caption drawn at the bottom of every frame",
+					MaxLength:   maxCaptionRunes,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "delivery",
+					Description: "Get a link or the file itself (falls back to a link when too large)",
+					Choices: []*discordgo.ApplicationCommandOptionChoice{
+						{Name: "Link", Value: DeliveryLink},
+						{Name: "Attachment", Value: DeliveryAttachment},
+					},
+				},
+			},
+		},
+		{
+			Name:        "editgif",
+			Description: "Reverse, speed up or boomerang a GIF",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionAttachment,
+					Name:        "file",
+					Description: "GIF to edit",
+					Required:    true,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "reverse",
+					Description: "Play the GIF backwards",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionNumber,
+					Name:        "speed",
+					Description: "Playback speed, eg. 2 for twice as fast or 0.5 for half speed",
+					MinValue:    &minSpeed,
+					MaxValue:    maxGifSpeed,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "boomerang",
+					Description: "Play the GIF forwards and then backwards",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "loops",
+					Description: "How many times the GIF plays, 0 loops forever",
+					MinValue:    &minLoops,
+					MaxValue:    100,
+				},
+				transformOptions[0],
+				transformOptions[1],
+				transformOptions[2],
+				transformOptions[3],
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "width",
+					Description: "Resize the GIF to this width in pixels",
+					MinValue:    &minWidth,
+					MaxValue:    float64(cfg.Conversion.MaxWidth),
+				},
+				transformOptions[4],
+			},
+		},
 	}
 
 	commandHandlers := map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){
 		"Transform files to GIFs": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
-			var attachments []*discordgo.MessageAttachment
-
-			message := i.Interaction.Message
+			message := targetMessage(i)
+			attachments := messageAttachments(i)
 
-			for _, message := range i.ApplicationCommandData().Resolved.Messages {
-				attachments = append(attachments, checkAttachments(message.Attachments, "image/")...)
-				attachments = append(attachments, checkAttachments(message.Attachments, "video/")...)
+			if len(attachments) == 0 {
+				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseChannelMessageWithSource,
+					Data: &discordgo.InteractionResponseData{
+						Flags:   discordgo.MessageFlagsEphemeral,
+						Content: "No valid file (image or video) attachments provided.",
+					},
+				})
+				return
 			}
 
-			if message != nil && len(message.Attachments) > 0 {
-				attachments = append(attachments, checkAttachments(message.Attachments, "image/")...)
-				attachments = append(attachments, checkAttachments(message.Attachments, "video/")...)
-
-			}
+			processAttachments(s, i, attachments, message, guildDelivery(s, i), attachmentConverter(guildVideoOptions(i.GuildID)))
+		},
+		"Archive existing GIF": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			message := targetMessage(i)
+			attachments := messageAttachments(i)
 
 			if len(attachments) == 0 {
 				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 					Type: discordgo.InteractionResponseChannelMessageWithSource,
 					Data: &discordgo.InteractionResponseData{
 						Flags:   discordgo.MessageFlagsEphemeral,
-						Content: "No valid file (image or video) attachments provided.",
+						Content: "No valid GIFs provided. Note that it has to be an uploaded gif, not a link (eg. from the favorites bar)",
 					},
 				})
 				return
 			}
 
-			processingMsg := "Processing file..."
+			processAttachments(s, i, attachments, message, guildDelivery(s, i), gifConverter("archive", func(_ *discordgo.MessageAttachment, source []byte) (*bytes.Buffer, error) {
+				return archiveGif(source)
+			}))
+		},
+		"gif": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			delivery := guildDelivery(s, i)
 
-			if len(attachments) > 1 {
-				processingMsg = "Processing files..."
+			attachment, opts, err := parseGifCommand(i.ApplicationCommandData(), guildVideoOptions(i.GuildID), &delivery)
+			if err != nil {
+				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseChannelMessageWithSource,
+					Data: &discordgo.InteractionResponseData{
+						Flags:   discordgo.MessageFlagsEphemeral,
+						Content: err.Error(),
+					},
+				})
+				return
 			}
 
-			s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-				Type: discordgo.InteractionResponseChannelMessageWithSource,
-				Data: &discordgo.InteractionResponseData{
-					Flags:   discordgo.MessageFlagsEphemeral,
-					Content: processingMsg,
-				},
-			})
-
-			var links []string
-			var wg sync.WaitGroup
-			var mu sync.Mutex
-			failedCount := 0
-
-			for _, a := range attachments {
-				wg.Add(1)
-
-				go func(attachment *discordgo.MessageAttachment) {
-					defer wg.Done()
-
-					var buf *bytes.Buffer
-					var err error
-
-					if strings.HasPrefix(attachment.ContentType, "image/") {
-						buf, err = downloadAndEncodeToGif(attachment)
-					}
-
-					if strings.HasPrefix(attachment.ContentType, "video/") {
-						buf, err = downloadVideoAndEncodeToGif(attachment)
-					}
-
-					if err != nil {
-						fmt.Println("error processing attachment:", err)
-						mu.Lock()
-						failedCount++
-						mu.Unlock()
-						return
-					}
-
-					name := uuid.New()
-					fileName := fmt.Sprintf("%s.gif", name)
-
-					if !isRunningInDocker() {
-						fileName = fmt.Sprintf("%s_devenv.gif", name)
-					}
-
-					_, err = Upload(context.Background(), "/gifs", fileName, "", buf, message)
-					if err != nil {
-						fmt.Println("Error uploading file:", err)
-						mu.Lock()
-						failedCount++
-						mu.Unlock()
-						return
-					}
-
-					link := "https://p2gcdn.netstat.ovh" + "/gifs" + "/" + fileName
-
-					mu.Lock()
-					links = append(links, link)
-					mu.Unlock()
-				}(a)
+			processAttachments(s, i, []*discordgo.MessageAttachment{attachment}, nil, delivery, attachmentConverter(opts))
+		},
+		"editgif": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			attachment, edit, err := parseEditGifCommand(i.ApplicationCommandData())
+			if err != nil {
+				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseChannelMessageWithSource,
+					Data: &discordgo.InteractionResponseData{
+						Flags:   discordgo.MessageFlagsEphemeral,
+						Content: err.Error(),
+					},
+				})
+				return
 			}
 
-			wg.Wait()
+			q := AppConfig.GuildQuantization(i.GuildID)
 
-			failedCountMessage := " file failed to process."
+			processAttachments(s, i, []*discordgo.MessageAttachment{attachment}, nil, guildDelivery(s, i), gifConverter(fmt.Sprintf("edit %+v %+v", edit, q), func(attachment *discordgo.MessageAttachment, source []byte) (*bytes.Buffer, error) {
+				return editGifSource(attachment, source, edit, q)
+			}))
+		},
+		"Clip video to GIF": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			attachments := messageAttachments(i)
 
-			if failedCount > 1 {
-				failedCountMessage = " files failed to process."
+			if len(attachments) == 0 {
+				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseChannelMessageWithSource,
+					Data: &discordgo.InteractionResponseData{
+						Flags:   discordgo.MessageFlagsEphemeral,
+						Content: "No videos found on this message.",
+					},
+				})
+				return
 			}
 
-			joined := strings.Join(links, "\n")
-			if failedCount > 0 {
-				joined += fmt.Sprintf("\n\n%d %s", failedCount, failedCountMessage)
-			}
+			storePendingModal(i.ID, attachments, targetMessage(i))
 
-			s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
-				Content: &joined,
+			s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseModal,
+				Data: &discordgo.InteractionResponseData{
+					CustomID: "clip:" + i.ID,
+					Title:    "Clip video to GIF",
+					Components: []discordgo.MessageComponent{
+						textInputRow("start", "Start (eg. 1:23)", "0:00", true),
+						textInputRow("end", "End (eg. 1:29)", "0:10", true),
+					},
+				},
 			})
 		},
-		"Archive existing GIF": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
-			var attachments []*discordgo.MessageAttachment
-
-			message := i.Interaction.Message
+		"Combine images into GIF": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			attachments := messageAttachments(i)
 
-			for _, message := range i.ApplicationCommandData().Resolved.Messages {
-				attachments = append(attachments, checkAttachments(message.Attachments, "image/gif")...)
+			if len(attachments) < 2 {
+				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseChannelMessageWithSource,
+					Data: &discordgo.InteractionResponseData{
+						Flags:   discordgo.MessageFlagsEphemeral,
+						Content: "This message needs at least two images to combine.",
+					},
+				})
+				return
 			}
 
-			if message != nil && len(message.Attachments) > 0 {
-				attachments = append(attachments, checkAttachments(message.Attachments, "image/gif")...)
-			}
+			storePendingModal(i.ID, attachments, targetMessage(i))
+
+			s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseModal,
+				Data: &discordgo.InteractionResponseData{
+					CustomID: "slideshow:" + i.ID,
+					Title:    "Combine images into GIF",
+					Components: []discordgo.MessageComponent{
+						textInputRow("delay", "Delay per image in milliseconds", "500", false),
+						textInputRow("sizing", "Sizing: fit, fill or letterbox", SizingFit, false),
+					},
+				},
+			})
+		},
+		"Caption as GIF": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			attachments := messageAttachments(i)
 
 			if len(attachments) == 0 {
 				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 					Type: discordgo.InteractionResponseChannelMessageWithSource,
 					Data: &discordgo.InteractionResponseData{
 						Flags:   discordgo.MessageFlagsEphemeral,
-						Content: "No valid GIFs provided. Note that it has to be an uploaded gif, not a link (eg. from the favorites bar)",
+						Content: "No valid file (image or video) attachments provided.",
 					},
 				})
 				return
 			}
 
+			storePendingModal(i.ID, attachments, targetMessage(i))
+
 			s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Type: discordgo.InteractionResponseModal,
 				Data: &discordgo.InteractionResponseData{
-					Flags:   discordgo.MessageFlagsEphemeral,
-					Content: "Processing images...",
+					CustomID: "caption:" + i.ID,
+					Title:    "Caption as GIF",
+					Components: []discordgo.MessageComponent{
+						captionInputRow("top", "Top text"),
+						captionInputRow("bottom", "Bottom text"),
+					},
 				},
 			})
-
-			var links []string
-			var wg sync.WaitGroup
-			var mu sync.Mutex
-
-			for _, a := range attachments {
-				wg.Add(1)
-
-				go func(attachment *discordgo.MessageAttachment) {
-					defer wg.Done()
-
-					buf, err := downloadGif(attachment)
-					if err != nil {
-						fmt.Println("error processing attachment:", err)
-						return
-					}
-
-					name := uuid.New()
-					fileName := fmt.Sprintf("%s.gif", name)
-
-					if !isRunningInDocker() {
-						fileName = fmt.Sprintf("%s_devenv.gif", name)
-					}
-
-					_, err = Upload(context.Background(), "/gifs", fileName, "", buf, message)
-					if err != nil {
-						fmt.Println("Error uploading file:", err)
-						return
-					}
-
-					link := "https://p2gcdn.netstat.ovh" + "/gifs" + "/" + fileName
-
-					mu.Lock()
-					links = append(links, link)
-					mu.Unlock()
-				}(a)
+		},
+		"mygifs": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			data, err := galleryPage(interactionUser(i).ID, 0)
+			if err != nil {
+				slog.Error("[DATABASE] Failed to list conversions", "error", err)
+				data = &discordgo.InteractionResponseData{
+					Flags:   discordgo.MessageFlagsEphemeral,
+					Content: "Couldn't load your conversions, try again later.",
+				}
 			}
 
-			wg.Wait()
-
-			joined := strings.Join(links, "\n")
+			s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: data,
+			})
+		},
+		"delete": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			link := i.ApplicationCommandData().Options[0].StringValue()
 
-			s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
-				Content: &joined,
+			respondDeleted(s, i, func() (bool, error) {
+				return deleteLink(interactionUser(i).ID, link)
 			})
 		},
 		"stats": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
@@ -341,7 +559,7 @@ func main() {
 					},
 				},
 				Footer: &discordgo.MessageEmbedFooter{
-					Text: fmt.Sprintf("%s-%s | Ping: %dms", os.Getenv("BUNNYNET_MC_REGION"), os.Getenv("BUNNYNET_MC_PODID"), s.HeartbeatLatency().Milliseconds()),
+					Text: fmt.Sprintf("%s-%s | Ping: %dms", AppConfig.Instance.Region, AppConfig.Instance.PodID, s.HeartbeatLatency().Milliseconds()),
 				},
 			}
 
@@ -354,7 +572,119 @@ func main() {
 		},
 	}
 
-	dg, err := discordgo.New("Bot " + os.Getenv("BOT_TOKEN"))
+	modalHandlers := map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, id string){
+		"clip": func(s *discordgo.Session, i *discordgo.InteractionCreate, id string) {
+			pending, ok := takePendingModal(id)
+			if !ok {
+				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseChannelMessageWithSource,
+					Data: &discordgo.InteractionResponseData{
+						Flags:   discordgo.MessageFlagsEphemeral,
+						Content: "This clip request expired, please run the command again.",
+					},
+				})
+				return
+			}
+
+			values := modalValues(i.ModalSubmitData())
+
+			opts := guildVideoOptions(i.GuildID)
+			err := parseClip(values["start"], values["end"], &opts)
+			if err == nil {
+				err = opts.Validate(AppConfig.Conversion)
+			}
+
+			if err != nil {
+				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseChannelMessageWithSource,
+					Data: &discordgo.InteractionResponseData{
+						Flags:   discordgo.MessageFlagsEphemeral,
+						Content: fmt.Sprintf("Invalid clip: %s.", err),
+					},
+				})
+				return
+			}
+
+			processAttachments(s, i, pending.attachments, pending.message, guildDelivery(s, i), videoOnly(attachmentConverter(opts)))
+		},
+		"caption": func(s *discordgo.Session, i *discordgo.InteractionCreate, id string) {
+			pending, ok := takePendingModal(id)
+			if !ok {
+				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseChannelMessageWithSource,
+					Data: &discordgo.InteractionResponseData{
+						Flags:   discordgo.MessageFlagsEphemeral,
+						Content: "This request expired, please run the command again.",
+					},
+				})
+				return
+			}
+
+			values := modalValues(i.ModalSubmitData())
+
+			opts := guildVideoOptions(i.GuildID)
+			opts.Caption = Caption{Top: values["top"], Bottom: values["bottom"]}
+
+			if opts.Caption.Empty() {
+				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseChannelMessageWithSource,
+					Data: &discordgo.InteractionResponseData{
+						Flags:   discordgo.MessageFlagsEphemeral,
+						Content: "Enter a top or bottom text.",
+					},
+				})
+				return
+			}
+
+			processAttachments(s, i, pending.attachments, pending.message, guildDelivery(s, i), attachmentConverter(opts))
+		},
+		"slideshow": func(s *discordgo.Session, i *discordgo.InteractionCreate, id string) {
+			pending, ok := takePendingModal(id)
+			if !ok {
+				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseChannelMessageWithSource,
+					Data: &discordgo.InteractionResponseData{
+						Flags:   discordgo.MessageFlagsEphemeral,
+						Content: "This request expired, please run the command again.",
+					},
+				})
+				return
+			}
+
+			values := modalValues(i.ModalSubmitData())
+
+			opts, err := parseSlideshowOptions(values["delay"], values["sizing"])
+			if err != nil {
+				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseChannelMessageWithSource,
+					Data: &discordgo.InteractionResponseData{
+						Flags:   discordgo.MessageFlagsEphemeral,
+						Content: fmt.Sprintf("Invalid options: %s.", err),
+					},
+				})
+				return
+			}
+
+			// All images become a single GIF, so they are processed as one job
+			// under the first attachment.
+			q := AppConfig.GuildQuantization(i.GuildID)
+
+			// Attachments can't change, so their IDs stand in for the
+			// contents of the images after the first.
+			var ids []string
+			for _, attachment := range pending.attachments {
+				ids = append(ids, attachment.ID)
+			}
+
+			params := fmt.Sprintf("slideshow %+v %+v %s", opts, q, strings.Join(ids, ","))
+
+			processAttachments(s, i, pending.attachments[:1], pending.message, guildDelivery(s, i), gifConverter(params, func(_ *discordgo.MessageAttachment, source []byte) (*bytes.Buffer, error) {
+				return downloadSlideshow(pending.attachments, source, opts, q)
+			}))
+		},
+	}
+
+	dg, err := discordgo.New("Bot " + cfg.Discord.Token)
 	if err != nil {
 		fmt.Println("error creating Discord session,", err)
 		return
@@ -362,11 +692,82 @@ func main() {
 
 	dg.Identify.Intents = discordgo.IntentsGuildMessages | discordgo.IntentMessageContent
 
+	// componentHandlers get the part of the custom ID after the handler name,
+	// eg. "page:2" for "mygifs:page:2".
+	componentHandlers := map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, args string){
+		"mygifs": func(s *discordgo.Session, i *discordgo.InteractionCreate, args string) {
+			action, value, _ := strings.Cut(args, ":")
+			userID := interactionUser(i).ID
+
+			var data *discordgo.InteractionResponseData
+			var err error
+
+			switch action {
+			case "page":
+				page, _ := strconv.Atoi(value)
+				data, err = galleryPage(userID, max(0, page))
+			case "select":
+				page, _ := strconv.Atoi(value)
+
+				var id int64
+				if values := i.MessageComponentData().Values; len(values) > 0 {
+					id, _ = strconv.ParseInt(values[0], 10, 64)
+				}
+
+				data, err = galleryEntry(userID, id, page)
+				if errors.Is(err, ErrConversionNotFound) {
+					data, err = galleryPage(userID, page)
+				}
+			default:
+				return
+			}
+
+			if err != nil {
+				slog.Error("[DATABASE] Failed to list conversions", "error", err)
+				s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseChannelMessageWithSource,
+					Data: &discordgo.InteractionResponseData{
+						Flags:   discordgo.MessageFlagsEphemeral,
+						Content: "Couldn't load your conversions, try again later.",
+					},
+				})
+				return
+			}
+
+			s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseUpdateMessage,
+				Data: data,
+			})
+		},
+		"delete": func(s *discordgo.Session, i *discordgo.InteractionCreate, id string) {
+			respondDeleted(s, i, func() (bool, error) {
+				return deleteByID(interactionUser(i).ID, id)
+			})
+		},
+	}
+
 	dg.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
-		slog.Info("Command ran", "userId", i.Member.User.ID, "command", i.ApplicationCommandData().Name)
+		switch i.Type {
+		case discordgo.InteractionApplicationCommand:
+			slog.Info("Command ran", "userId", interactionUser(i).ID, "command", i.ApplicationCommandData().Name)
+
+			if h, ok := commandHandlers[i.ApplicationCommandData().Name]; ok {
+				h(s, i)
+			}
+		case discordgo.InteractionModalSubmit:
+			name, id, _ := strings.Cut(i.ModalSubmitData().CustomID, ":")
 
-		if h, ok := commandHandlers[i.ApplicationCommandData().Name]; ok {
-			h(s, i)
+			slog.Info("Modal submitted", "userId", interactionUser(i).ID, "modal", name)
+
+			if h, ok := modalHandlers[name]; ok {
+				h(s, i, id)
+			}
+		case discordgo.InteractionMessageComponent:
+			name, args, _ := strings.Cut(i.MessageComponentData().CustomID, ":")
+
+			if h, ok := componentHandlers[name]; ok {
+				h(s, i, args)
+			}
 		}
 	})
 
@@ -463,18 +864,225 @@ func updateMetrics(dg *discordgo.Session) {
 	}
 }
 
-func checkAttachments(attachments []*discordgo.MessageAttachment, contentTypePrefix string) (attachs []*discordgo.MessageAttachment) {
-	if contentTypePrefix == "" {
-		contentTypePrefix = "image/"
+// interactionUser returns who ran the interaction, Member is only set in guilds.
+func interactionUser(i *discordgo.InteractionCreate) *discordgo.User {
+	if i.Member != nil {
+		return i.Member.User
+	}
+
+	return i.User
+}
+
+// targetMessage is the message a message command was run on.
+func targetMessage(i *discordgo.InteractionCreate) *discordgo.Message {
+	data := i.ApplicationCommandData()
+	if data.Resolved == nil {
+		return nil
+	}
+
+	return data.Resolved.Messages[data.TargetID]
+}
+
+// messageAttachments returns every file on the target message of a message
+// command. Their types aren't filtered, every file is sniffed once it is
+// downloaded and unsupported ones are reported by name.
+func messageAttachments(i *discordgo.InteractionCreate) []*discordgo.MessageAttachment {
+	message := targetMessage(i)
+	if message == nil {
+		return nil
+	}
+
+	return message.Attachments
+}
+
+// guildUploadLimit is the largest file members of the guild can upload, which
+// depends on its boost tier.
+func guildUploadLimit(s *discordgo.Session, guildID string) int64 {
+	const mb = 1024 * 1024
+
+	if guildID == "" {
+		return 10 * mb
+	}
+
+	guild, err := s.State.Guild(guildID)
+	if err != nil || guild.Unavailable {
+		guild, err = s.Guild(guildID)
+	}
+
+	if err == nil {
+		switch guild.PremiumTier {
+		case discordgo.PremiumTier2:
+			return 50 * mb
+		case discordgo.PremiumTier3:
+			return 100 * mb
+		}
+	}
+
+	return 10 * mb
+}
+
+// parseGifCommand reads the attachment and conversion options of /gif on top
+// of opts. The delivery option overrides the guild default in delivery.
+func parseGifCommand(data discordgo.ApplicationCommandInteractionData, opts VideoOptions, delivery *Delivery) (*discordgo.MessageAttachment, VideoOptions, error) {
+	var attachment *discordgo.MessageAttachment
+	var start, end string
+	hasDuration := false
+	hasWidth := false
+
+	for _, option := range data.Options {
+		switch option.Name {
+		case "file":
+			attachment = data.Resolved.Attachments[option.StringValue()]
+		case "fps":
+			opts.FPS = int(option.IntValue())
+		case "width":
+			opts.Width = int(option.IntValue())
+			hasWidth = true
+		case "start":
+			start = option.StringValue()
+		case "end":
+			end = option.StringValue()
+		case "duration":
+			opts.Duration = time.Duration(option.FloatValue() * float64(time.Second))
+			hasDuration = true
+		case "dither":
+			opts.Dither = option.StringValue()
+		case "quantizer":
+			opts.Quantizer = option.StringValue()
+		case "colors":
+			opts.Colors = int(option.IntValue())
+		case "format":
+			format, ok := outputFormats[option.StringValue()]
+			if !ok {
+				return nil, opts, fmt.Errorf("Unknown format %q.", option.StringValue())
+			}
+			opts.Format = format
+		case "fit":
+			if option.BoolValue() && opts.MaxBytes == 0 {
+				opts.MaxBytes = delivery.MaxAttachmentBytes
+			}
+		case "max_size":
+			opts.MaxBytes = int64(option.FloatValue() * 1024 * 1024)
+		case "top_text":
+			opts.Caption.Top = option.StringValue()
+		case "bottom_text":
+			opts.Caption.Bottom = option.StringValue()
+		case "delivery":
+			delivery.Mode = option.StringValue()
+		default:
+			if err := parseTransformOption(option, &opts.Transform); err != nil {
+				return nil, opts, fmt.Errorf("Invalid options: %s.", err)
+			}
+		}
+	}
+
+	if end != "" && hasDuration {
+		return nil, opts, fmt.Errorf("Use either end or duration, not both.")
+	}
+
+	if err := parseClip(start, end, &opts); err != nil {
+		return nil, opts, fmt.Errorf("Invalid options: %s.", err)
+	}
+
+	if attachment == nil {
+		return nil, opts, fmt.Errorf("No file attachment provided.")
+	}
+
+	// The format is only known once the file is sniffed, videos ignore the
+	// width of the transform and refuse the rest of it then.
+	if hasWidth {
+		opts.Transform.Width = opts.Width
+	}
+
+	if err := opts.Validate(AppConfig.Conversion); err != nil {
+		return nil, opts, fmt.Errorf("Invalid options: %s.", err)
+	}
+
+	return attachment, opts, nil
+}
+
+// parseEditGifCommand reads the attachment and edits of /editgif.
+func parseEditGifCommand(data discordgo.ApplicationCommandInteractionData) (*discordgo.MessageAttachment, GifEdit, error) {
+	edit := DefaultGifEdit()
+
+	var attachment *discordgo.MessageAttachment
+
+	for _, option := range data.Options {
+		switch option.Name {
+		case "file":
+			attachment = data.Resolved.Attachments[option.StringValue()]
+		case "reverse":
+			edit.Reverse = option.BoolValue()
+		case "speed":
+			edit.Speed = option.FloatValue()
+		case "boomerang":
+			edit.Boomerang = option.BoolValue()
+		case "loops":
+			edit.Loops = int(option.IntValue())
+		default:
+			if err := parseTransformOption(option, &edit.Transform); err != nil {
+				return nil, edit, fmt.Errorf("Invalid options: %s.", err)
+			}
+		}
+	}
+
+	if attachment == nil {
+		return nil, edit, fmt.Errorf("No GIF attachment provided.")
+	}
+
+	if err := edit.Validate(AppConfig.Conversion); err != nil {
+		return nil, edit, fmt.Errorf("Invalid options: %s.", err)
+	}
+
+	return attachment, edit, nil
+}
+
+// parseTransformOption reads the crop, aspect, rotate, flip, filter and width
+// options shared by /gif and /editgif.
+func parseTransformOption(option *discordgo.ApplicationCommandInteractionDataOption, t *Transform) error {
+	switch option.Name {
+	case "crop":
+		crop, err := parseCrop(option.StringValue())
+		if err != nil {
+			return err
+		}
+		t.Crop = crop
+	case "aspect":
+		t.Aspect = option.StringValue()
+	case "rotate":
+		t.Rotate = int(option.IntValue())
+	case "flip":
+		flip := option.StringValue()
+		t.FlipH = flip == "horizontal" || flip == "both"
+		t.FlipV = flip == "vertical" || flip == "both"
+	case "filter":
+		t.Filter = option.StringValue()
+	case "width":
+		t.Width = int(option.IntValue())
+	}
+
+	return nil
+}
+
+// parseClip sets Start and End from user supplied timestamps, either may be empty.
+func parseClip(start string, end string, opts *VideoOptions) error {
+	if strings.TrimSpace(start) != "" {
+		t, err := parseTimestamp(start)
+		if err != nil {
+			return fmt.Errorf("invalid start time, use seconds (83.5) or minutes:seconds (1:23)")
+		}
+		opts.Start = t
 	}
 
-	for _, attc := range attachments {
-		if strings.HasPrefix(attc.ContentType, contentTypePrefix) {
-			attachs = append(attachs, attc)
+	if strings.TrimSpace(end) != "" {
+		t, err := parseTimestamp(end)
+		if err != nil {
+			return fmt.Errorf("invalid end time, use seconds (89) or minutes:seconds (1:29)")
 		}
+		opts.End = t
 	}
 
-	return attachs
+	return nil
 }
 
 func bytesToReadable(bytes int64) string {
@@ -490,138 +1098,155 @@ func bytesToReadable(bytes int64) string {
 	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
 
-func downloadGif(attachment *discordgo.MessageAttachment) (*bytes.Buffer, error) {
-	resp, err := http.Get(attachment.URL)
+func decodeGif(source []byte) (*gif.GIF, error) {
+	media, err := sniffMedia(source)
 	if err != nil {
-		fmt.Println("Error downloading attachment:", err)
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	g, err := gif.DecodeAll(resp.Body)
+	if media.Name != MediaGIF.Name {
+		return nil, newUserError("Unsupported format: %s, this only works on GIFs.", media.Name)
+	}
+
+	if err := checkImageSize(source); err != nil {
+		return nil, err
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(source))
 	if err != nil {
 		fmt.Println("Error decoding GIF:", err)
 		return nil, err
 	}
 
-	buf := new(bytes.Buffer)
+	return g, nil
+}
+
+// archiveGif re-encodes a GIF for archiving, optimized if that makes it smaller.
+func archiveGif(source []byte) (*bytes.Buffer, error) {
+	g, err := decodeGif(source)
+	if err != nil {
+		return nil, err
+	}
 
-	err = gif.EncodeAll(buf, g)
+	out, err := smallestEncoding(g, source, "archive")
 	if err != nil {
 		fmt.Println("Error encoding GIF:", err)
 		return nil, err
 	}
 
-	return buf, nil
+	return bytes.NewBuffer(out), nil
 }
 
-func downloadAndEncodeToGif(attachment *discordgo.MessageAttachment) (*bytes.Buffer, error) {
-	resp, err := http.Get(attachment.URL)
-
+func decodeImage(source []byte) (image.Image, error) {
+	media, err := sniffMedia(source)
 	if err != nil {
-		fmt.Println("Error downloading attachment:", err)
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	img, format, err := image.Decode(resp.Body)
-	if err != nil {
-		fmt.Println("Error decoding image:", err)
-		return nil, err
+	if media.Pipeline != PipelineImage {
+		return nil, newUserError("Unsupported format: %s, this only works on images.", media.Name)
 	}
 
-	fmt.Printf("Detected image format: %s\n", format)
+	if media.FFmpegDecode {
+		return decodeWithFFmpeg(source, media)
+	}
 
-	images := []image.Image{img}
-	gifImage := easygif.MostCommonColors(images, 0)
+	if err := checkImageSize(source); err != nil {
+		return nil, err
+	}
 
-	buf := new(bytes.Buffer)
-	err = gif.EncodeAll(buf, gifImage)
+	img, imageFormat, err := image.Decode(bytes.NewReader(source))
 	if err != nil {
-		fmt.Println("Error encoding GIF:", err)
+		fmt.Println("Error decoding image:", err)
 		return nil, err
 	}
 
-	return buf, nil
+	fmt.Printf("Detected image format: %s\n", imageFormat)
+
+	return img, nil
 }
 
-func downloadVideoAndEncodeToGif(attachment *discordgo.MessageAttachment) (*bytes.Buffer, error) {
-	resp, err := http.Get(attachment.URL)
+// encodeImage converts a still image, using the format, caption and
+// transform of opts.
+func encodeImage(source []byte, opts VideoOptions) (*Converted, error) {
+	img, err := decodeImage(source)
 	if err != nil {
-		return nil, fmt.Errorf("failed to download video: %w", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	tmpIn, err := os.CreateTemp("", "input-*.mp4")
-	if err != nil {
-		return nil, fmt.Errorf("failed to create temp input file: %w", err)
+	if !opts.Transform.Empty() {
+		img, err = opts.Transform.Apply(img)
+		if err != nil {
+			return nil, err
+		}
 	}
-	defer os.Remove(tmpIn.Name())
 
-	_, err = io.Copy(tmpIn, resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to write to temp input file: %w", err)
+	if !opts.Caption.Empty() {
+		img, err = captionImage(img, opts.Caption)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	tmpIn.Close()
+	return encodeStill(img, opts.Format, opts.quantization())
+}
 
-	tmpOut, err := os.CreateTemp("", "output-*.gif")
+// encodeAnimatedGif is encodeImage for animated GIFs, the transform and
+// caption are applied to every frame and the timing is kept.
+func encodeAnimatedGif(source []byte, opts VideoOptions) (*Converted, error) {
+	g, err := decodeGif(source)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create temp output file: %w", err)
+		return nil, err
 	}
-	defer os.Remove(tmpOut.Name())
-	tmpOut.Close()
 
-	tmpPalette, err := os.CreateTemp("", "palette-*.png")
-	if err != nil {
-		return nil, fmt.Errorf("failed to create temp palette file: %w", err)
+	frames := coalesceGif(g)
+
+	if !opts.Transform.Empty() {
+		if err := opts.Transform.CheckSize(frames[0].Rect, len(frames)); err != nil {
+			return nil, err
+		}
 	}
-	defer os.Remove(tmpPalette.Name())
 
-	ffmpegLocation := "bin/ffmpeg-win/ffmpeg.exe"
+	for i, frame := range frames {
+		if !opts.Transform.Empty() {
+			frame, err = opts.Transform.Apply(frame)
+			if err != nil {
+				return nil, err
+			}
+		}
 
-	if isRunningInDocker() {
-		ffmpegLocation = "ffmpeg"
+		frames[i] = frame
 	}
 
-	cmd1 := exec.Command(ffmpegLocation,
-		"-t", "10",
-		"-i", tmpIn.Name(),
-		"-vf", "fps=12,scale=480:-1:flags=lanczos,palettegen",
-		"-y",
-		tmpPalette.Name(),
-	)
+	if !opts.Caption.Empty() {
+		// Every frame has the same size, the caption is only rendered once.
+		bounds := frames[0].Rect
 
-	var stderr1 bytes.Buffer
-	cmd1.Stderr = &stderr1
+		overlay, err := captionOverlay(bounds.Dx(), bounds.Dy(), opts.Caption)
+		if err != nil {
+			return nil, err
+		}
 
-	if err := cmd1.Run(); err != nil {
-		return nil, fmt.Errorf("failed to generate palette: %v\n%s", err, stderr1.String())
+		for _, frame := range frames {
+			draw.Draw(frame, frame.Rect, overlay, image.Point{}, draw.Over)
+		}
 	}
 
-	cmd2 := exec.Command(ffmpegLocation,
-		"-t", "10",
-		"-i", tmpIn.Name(),
-		"-i", tmpPalette.Name(),
-		//"-lavfi", "fps=12,scale=480:-1:flags=lanczos [x]; [x][1:v] paletteuse=dither=sierra2_4a",
-		"-lavfi", "fps=8,scale=480:-1:flags=lanczos[x];[x][1:v]paletteuse=dither=bayer:bayer_scale=3",
-		"-y",
-		tmpOut.Name(),
-	)
-
-	var stderr2 bytes.Buffer
-	cmd2.Stderr = &stderr2
+	out, err := smallestEncoding(encodeFrames(frames, gifDelays(g), g.LoopCount, opts.quantization()), nil, "edit")
+	if err != nil {
+		return nil, err
+	}
 
-	if err := cmd2.Run(); err != nil {
-		return nil, fmt.Errorf("ffmpeg error: %v\n%s", err, stderr2.String())
+	if opts.Format == FormatGIF {
+		return &Converted{Data: bytes.NewBuffer(out), Format: FormatGIF}, nil
 	}
 
-	outBytes, err := os.ReadFile(tmpOut.Name())
+	converted, err := encodeAnimation(out, opts.Format)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read output file: %w", err)
+		return nil, err
 	}
 
-	return bytes.NewBuffer(outBytes), nil
+	return &Converted{Data: bytes.NewBuffer(converted), Format: opts.Format}, nil
 }
 
 func onConnect(s *discordgo.Session, _ *discordgo.Connect) {
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// pendingModal remembers what a message command was used on while the user
+// fills out the modal it opened.
+type pendingModal struct {
+	attachments []*discordgo.MessageAttachment
+	message     *discordgo.Message
+	expires     time.Time
+}
+
+var (
+	pendingModalsMu sync.Mutex
+	pendingModals   = map[string]pendingModal{}
+)
+
+// storePendingModal saves the attachments under the interaction ID, which is
+// then used as the modal custom ID suffix.
+func storePendingModal(id string, attachments []*discordgo.MessageAttachment, message *discordgo.Message) {
+	pendingModalsMu.Lock()
+	defer pendingModalsMu.Unlock()
+
+	now := time.Now()
+
+	for key, pending := range pendingModals {
+		if now.After(pending.expires) {
+			delete(pendingModals, key)
+		}
+	}
+
+	pendingModals[id] = pendingModal{
+		attachments: attachments,
+		message:     message,
+		expires:     now.Add(15 * time.Minute),
+	}
+}
+
+func takePendingModal(id string) (pendingModal, bool) {
+	pendingModalsMu.Lock()
+	defer pendingModalsMu.Unlock()
+
+	pending, ok := pendingModals[id]
+	delete(pendingModals, id)
+
+	if !ok || time.Now().After(pending.expires) {
+		return pendingModal{}, false
+	}
+
+	return pending, true
+}
+
+// modalValues flattens the text inputs of a submitted modal into a map keyed
+// by their custom IDs.
+func modalValues(data discordgo.ModalSubmitInteractionData) map[string]string {
+	values := map[string]string{}
+
+	for _, component := range data.Components {
+		row, ok := component.(*discordgo.ActionsRow)
+		if !ok {
+			continue
+		}
+
+		for _, c := range row.Components {
+			if input, ok := c.(*discordgo.TextInput); ok {
+				values[input.CustomID] = input.Value
+			}
+		}
+	}
+
+	return values
+}
+
+func textInputRow(customID string, label string, placeholder string, required bool) discordgo.ActionsRow {
+	return discordgo.ActionsRow{
+		Components: []discordgo.MessageComponent{
+			discordgo.TextInput{
+				CustomID:    customID,
+				Label:       label,
+				Style:       discordgo.TextInputShort,
+				Placeholder: placeholder,
+				Required:    required,
+				MaxLength:   16,
+			},
+		},
+	}
+}
+
+// captionInputRow is a text input for caption text, which needs more room
+// than the short inputs of textInputRow.
+func captionInputRow(customID string, label string) discordgo.ActionsRow {
+	return discordgo.ActionsRow{
+		Components: []discordgo.MessageComponent{
+			discordgo.TextInput{
+				CustomID:  customID,
+				Label:     label,
+				Style:     discordgo.TextInputParagraph,
+				Required:  false,
+				MaxLength: maxCaptionRunes,
+			},
+		},
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"log/slog"
+)
+
+// optimizeGif rebuilds g so that every frame only stores the rectangle that
+// changed since the frame before it, with unchanged pixels inside that
+// rectangle made transparent so they compress better. Identical frames are
+// merged into one with their delays summed. lossy is how far (RGB distance)
+// a pixel may drift before it counts as changed, 0 keeps the GIF lossless.
+//
+// Frames share one palette when every color fits in it, otherwise each frame
+// gets its own. It returns nil when a single frame has too many colors for a
+// palette, g is better left as it is then.
+func optimizeGif(g *gif.GIF, lossy int) *gif.GIF {
+	frames := coalesceGif(g)
+	delays := gifDelays(g)
+	alphaThreshold := uint8(AppConfig.Conversion.AlphaThreshold)
+
+	var kept []*image.RGBA
+	var keptDelays []int
+
+	for i, frame := range frames {
+		if len(kept) > 0 && similarFrames(kept[len(kept)-1], frame, lossy) {
+			keptDelays[len(keptDelays)-1] += delays[i]
+			continue
+		}
+
+		kept = append(kept, frame)
+		keptDelays = append(keptDelays, delays[i])
+	}
+
+	// Frame differencing can only draw over the previous frame, pixels that
+	// turn transparent need the full frames with background disposal.
+	clears := turnsTransparent(kept, alphaThreshold)
+
+	if !fitsOnePalette(kept, alphaThreshold) {
+		return optimizeLocalPalettes(kept, keptDelays, g.LoopCount, lossy, clears)
+	}
+
+	images := make([]image.Image, len(kept))
+	for i, frame := range kept {
+		images[i] = frame
+	}
+
+	full := quantizeWithAlpha(images, 0, alphaThreshold)
+	full.Delay = keptDelays
+	full.LoopCount = g.LoopCount
+
+	if clears {
+		return full
+	}
+
+	palette := full.Image[0].Palette
+	transparent := -1
+
+	for i, c := range palette {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			transparent = i
+			break
+		}
+	}
+
+	if transparent < 0 && len(palette) < 256 {
+		palette = append(palette[:len(palette):len(palette)], transparentColor)
+		transparent = len(palette) - 1
+	}
+
+	out := &gif.GIF{
+		Image:     []*image.Paletted{full.Image[0]},
+		Delay:     []int{full.Delay[0]},
+		Disposal:  []byte{gif.DisposalNone},
+		LoopCount: full.LoopCount,
+	}
+	out.Image[0].Palette = palette
+
+	display := make([]uint8, len(full.Image[0].Pix))
+	copy(display, full.Image[0].Pix)
+
+	stride := full.Image[0].Stride
+	bounds := full.Image[0].Rect
+
+	changed := func(cur uint8, shown uint8) bool {
+		if cur == shown {
+			return false
+		}
+
+		if lossy == 0 || int(cur) == transparent || int(shown) == transparent {
+			return true
+		}
+
+		return !colorsWithin(palette[cur], palette[shown], lossy)
+	}
+
+	for i := 1; i < len(full.Image); i++ {
+		cur := full.Image[i]
+
+		rect := image.Rectangle{}
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				p := y*stride + x
+				if changed(cur.Pix[p], display[p]) {
+					rect = rect.Union(image.Rect(x, y, x+1, y+1))
+				}
+			}
+		}
+
+		if rect.Empty() {
+			out.Delay[len(out.Delay)-1] += full.Delay[i]
+			continue
+		}
+
+		sub := image.NewPaletted(rect.Add(bounds.Min), palette)
+
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				p := y*stride + x
+				q := (y-rect.Min.Y)*sub.Stride + (x - rect.Min.X)
+
+				if !changed(cur.Pix[p], display[p]) && transparent >= 0 {
+					sub.Pix[q] = uint8(transparent)
+					continue
+				}
+
+				sub.Pix[q] = cur.Pix[p]
+				display[p] = cur.Pix[p]
+			}
+		}
+
+		out.Image = append(out.Image, sub)
+		out.Delay = append(out.Delay, full.Delay[i])
+		out.Disposal = append(out.Disposal, gif.DisposalNone)
+	}
+
+	return out
+}
+
+// turnsTransparent reports whether any opaque pixel becomes transparent in
+// the next frame.
+func turnsTransparent(frames []*image.RGBA, alphaThreshold uint8) bool {
+	for i := 1; i < len(frames); i++ {
+		prev, cur := frames[i-1].Pix, frames[i].Pix
+
+		for p := 3; p < len(cur); p += 4 {
+			if cur[p] < alphaThreshold && prev[p] >= alphaThreshold {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// fitsOnePalette reports whether the colors of all frames fit in a single
+// palette, with an entry left for transparency when it is needed.
+func fitsOnePalette(frames []*image.RGBA, alphaThreshold uint8) bool {
+	colors := map[[3]uint8]bool{}
+	size := 256
+
+	for _, frame := range frames {
+		for p := 0; p < len(frame.Pix); p += 4 {
+			if frame.Pix[p+3] < alphaThreshold {
+				if size == 256 {
+					size--
+				}
+				continue
+			}
+
+			colors[[3]uint8{frame.Pix[p], frame.Pix[p+1], frame.Pix[p+2]}] = true
+		}
+
+		if len(colors) > size {
+			return false
+		}
+	}
+
+	return len(colors) <= size
+}
+
+// optimizeLocalPalettes is the frame differencing of optimizeGif for GIFs
+// with more colors than one palette holds, every frame gets a palette of its
+// own colors. It returns nil when a frame doesn't fit in one.
+func optimizeLocalPalettes(frames []*image.RGBA, delays []int, loopCount int, lossy int, clears bool) *gif.GIF {
+	alphaThreshold := uint8(AppConfig.Conversion.AlphaThreshold)
+	bounds := frames[0].Rect
+
+	out := &gif.GIF{LoopCount: loopCount}
+
+	if clears {
+		for i, frame := range frames {
+			img := localPaletted(frame, bounds, alphaThreshold, nil)
+			if img == nil {
+				return nil
+			}
+
+			out.Image = append(out.Image, img)
+			out.Delay = append(out.Delay, delays[i])
+			out.Disposal = append(out.Disposal, gif.DisposalBackground)
+		}
+
+		return out
+	}
+
+	first := localPaletted(frames[0], bounds, alphaThreshold, nil)
+	if first == nil {
+		return nil
+	}
+
+	out.Image = []*image.Paletted{first}
+	out.Delay = []int{delays[0]}
+	out.Disposal = []byte{gif.DisposalNone}
+
+	display := cloneRGBA(frames[0])
+
+	changed := func(cur *image.RGBA, p int) bool {
+		a, b := cur.Pix[p:p+4], display.Pix[p:p+4]
+
+		if (a[3] < alphaThreshold) != (b[3] < alphaThreshold) {
+			return true
+		}
+
+		if a[3] < alphaThreshold {
+			return false
+		}
+
+		if lossy == 0 {
+			return a[0] != b[0] || a[1] != b[1] || a[2] != b[2]
+		}
+
+		return !colorsWithin(color.RGBA{a[0], a[1], a[2], 255}, color.RGBA{b[0], b[1], b[2], 255}, lossy)
+	}
+
+	for i := 1; i < len(frames); i++ {
+		cur := frames[i]
+
+		rect := image.Rectangle{}
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				if changed(cur, cur.PixOffset(x, y)) {
+					rect = rect.Union(image.Rect(x, y, x+1, y+1))
+				}
+			}
+		}
+
+		if rect.Empty() {
+			out.Delay[len(out.Delay)-1] += delays[i]
+			continue
+		}
+
+		sub := localPaletted(cur, rect, alphaThreshold, func(p int) bool { return !changed(cur, p) })
+		if sub == nil {
+			return nil
+		}
+
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				if p := cur.PixOffset(x, y); changed(cur, p) {
+					copy(display.Pix[p:p+4], cur.Pix[p:p+4])
+				}
+			}
+		}
+
+		out.Image = append(out.Image, sub)
+		out.Delay = append(out.Delay, delays[i])
+		out.Disposal = append(out.Disposal, gif.DisposalNone)
+	}
+
+	return out
+}
+
+// localPaletted converts rect of frame to a paletted image with a palette of
+// exactly its colors. Pixels below alphaThreshold, or for which skip is true,
+// become transparent. It returns nil when the colors don't fit in a palette.
+func localPaletted(frame *image.RGBA, rect image.Rectangle, alphaThreshold uint8, skip func(p int) bool) *image.Paletted {
+	transparent := func(p int) bool {
+		return frame.Pix[p+3] < alphaThreshold || (skip != nil && skip(p))
+	}
+
+	indexes := map[[3]uint8]int{}
+	var palette color.Palette
+	hasTransparency := false
+
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			p := frame.PixOffset(x, y)
+			if transparent(p) {
+				hasTransparency = true
+				continue
+			}
+
+			rgb := [3]uint8{frame.Pix[p], frame.Pix[p+1], frame.Pix[p+2]}
+			if _, ok := indexes[rgb]; !ok {
+				indexes[rgb] = len(palette)
+				palette = append(palette, color.RGBA{rgb[0], rgb[1], rgb[2], 255})
+			}
+		}
+	}
+
+	offset := 0
+	if hasTransparency {
+		palette = append(color.Palette{transparentColor}, palette...)
+		offset = 1
+	}
+
+	if len(palette) > 256 {
+		return nil
+	}
+
+	if len(palette) == 0 {
+		palette = color.Palette{transparentColor}
+	}
+
+	img := image.NewPaletted(rect, palette)
+
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			p := frame.PixOffset(x, y)
+			if transparent(p) {
+				continue
+			}
+
+			img.Pix[img.PixOffset(x, y)] = uint8(indexes[[3]uint8{frame.Pix[p], frame.Pix[p+1], frame.Pix[p+2]}] + offset)
+		}
+	}
+
+	return img
+}
+
+func similarFrames(a *image.RGBA, b *image.RGBA, lossy int) bool {
+	if a.Rect != b.Rect {
+		return false
+	}
+
+	if lossy == 0 {
+		return bytes.Equal(a.Pix, b.Pix)
+	}
+
+	for p := 0; p < len(a.Pix); p += 4 {
+		if a.Pix[p+3] != b.Pix[p+3] {
+			return false
+		}
+
+		dr := int(a.Pix[p]) - int(b.Pix[p])
+		dg := int(a.Pix[p+1]) - int(b.Pix[p+1])
+		db := int(a.Pix[p+2]) - int(b.Pix[p+2])
+
+		if dr*dr+dg*dg+db*db > lossy*lossy {
+			return false
+		}
+	}
+
+	return true
+}
+
+// colorsWithin reports whether the euclidean RGB distance, in 8 bit steps,
+// between a and b is at most distance.
+func colorsWithin(a color.Color, b color.Color, distance int) bool {
+	ar, ag, ab, _ := a.RGBA()
+	br, bg, bb, _ := b.RGBA()
+
+	dr := int(ar>>8) - int(br>>8)
+	dg := int(ag>>8) - int(bg>>8)
+	db := int(ab>>8) - int(bb>>8)
+
+	return dr*dr+dg*dg+db*db <= distance*distance
+}
+
+// smallestEncoding optimizes g when the optimizer is enabled and returns
+// whichever of the optimized GIF and baseline is smaller. A nil baseline is
+// replaced by g encoded as is.
+func smallestEncoding(g *gif.GIF, baseline []byte, source string) ([]byte, error) {
+	if baseline == nil {
+		buf := new(bytes.Buffer)
+		if err := gif.EncodeAll(buf, g); err != nil {
+			return nil, fmt.Errorf("failed to encode GIF: %w", err)
+		}
+		baseline = buf.Bytes()
+	}
+
+	if !AppConfig.Conversion.Optimize || len(g.Image) == 0 {
+		return baseline, nil
+	}
+
+	out := optimizeGif(g, AppConfig.Conversion.Lossy)
+	if out == nil {
+		return baseline, nil
+	}
+
+	optimized := new(bytes.Buffer)
+	if err := gif.EncodeAll(optimized, out); err != nil {
+		slog.Warn("[OPTIMIZER] Failed to encode optimized GIF", "source", source, "error", err)
+		return baseline, nil
+	}
+
+	gifOptimizerInputBytes.WithLabelValues(source).Add(float64(len(baseline)))
+
+	if optimized.Len() >= len(baseline) {
+		return baseline, nil
+	}
+
+	gifOptimizerSavedBytes.WithLabelValues(source).Add(float64(len(baseline) - optimized.Len()))
+
+	return optimized.Bytes(), nil
+}
+
+// optimizeEncodedGif optimizes an already encoded GIF, eg. from ffmpeg. The
+// input is returned unchanged if it can't be decoded, or if decoding every
+// frame to the full canvas would take more memory than the decode limits
+// allow.
+func optimizeEncodedGif(data []byte, source string) []byte {
+	if !AppConfig.Conversion.Optimize {
+		return data
+	}
+
+	frames, canvas, err := scanGif(data)
+	if err != nil {
+		slog.Warn("[OPTIMIZER] Failed to read GIF", "source", source, "error", err)
+		return data
+	}
+
+	if reason := gifOverBudget(frames, canvas); reason != "" {
+		slog.Info("[OPTIMIZER] Skipping GIF over the decode limits", "source", source, "reason", reason, "frames", frames, "canvas", canvas)
+		return data
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		slog.Warn("[OPTIMIZER] Failed to decode GIF", "source", source, "error", err)
+		return data
+	}
+
+	out, err := smallestEncoding(g, data, source)
+	if err != nil {
+		return data
+	}
+
+	return out
+}
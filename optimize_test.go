@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+func useDefaultConfig(t *testing.T) {
+	t.Helper()
+
+	previous := AppConfig
+	AppConfig = defaultConfig()
+	t.Cleanup(func() { AppConfig = previous })
+}
+
+// fullPalette is 256 distinct opaque colors, different for every seed.
+func fullPalette(seed int) color.Palette {
+	palette := make(color.Palette, 256)
+	for i := range palette {
+		palette[i] = color.RGBA{uint8(i), uint8(seed * 50), uint8(255 - i), 255}
+	}
+
+	return palette
+}
+
+// noise fills img with every color of its palette, skipping the transparent
+// index if there is one.
+func noise(img *image.Paletted, transparent int) *image.Paletted {
+	for p := range img.Pix {
+		index := p % len(img.Palette)
+		if index == transparent {
+			index = (index + 1) % len(img.Palette)
+		}
+
+		img.Pix[p] = uint8(index)
+	}
+
+	return img
+}
+
+// samePlayback compares the frames shown at every point where either GIF
+// changes frames, so GIFs with merged frames can be compared.
+func samePlayback(t *testing.T, want *gif.GIF, got *gif.GIF) {
+	t.Helper()
+
+	wantFrames, gotFrames := coalesceGif(want), coalesceGif(got)
+	wantDelays, gotDelays := gifDelays(want), gifDelays(got)
+
+	total := func(delays []int) (sum int) {
+		for _, d := range delays {
+			sum += d
+		}
+		return sum
+	}
+
+	if total(wantDelays) != total(gotDelays) {
+		t.Fatalf("duration is %d, want %d", total(gotDelays), total(wantDelays))
+	}
+
+	frameAt := func(frames []*image.RGBA, delays []int, at int) *image.RGBA {
+		for i, d := range delays {
+			if at < d {
+				return frames[i]
+			}
+			at -= d
+		}
+		return frames[len(frames)-1]
+	}
+
+	var starts []int
+	for _, delays := range [][]int{wantDelays, gotDelays} {
+		at := 0
+		for _, d := range delays {
+			starts = append(starts, at)
+			at += d
+		}
+	}
+
+	for _, at := range starts {
+		w, g := frameAt(wantFrames, wantDelays, at), frameAt(gotFrames, gotDelays, at)
+
+		if w.Rect != g.Rect {
+			t.Fatalf("at %d: bounds are %v, want %v", at, g.Rect, w.Rect)
+		}
+
+		diff := 0
+		for p := 0; p < len(w.Pix); p += 4 {
+			// Fully transparent pixels can have any color.
+			if w.Pix[p+3] == 0 && g.Pix[p+3] == 0 {
+				continue
+			}
+
+			if !bytes.Equal(w.Pix[p:p+4], g.Pix[p:p+4]) {
+				diff++
+			}
+		}
+
+		if diff > 0 {
+			t.Fatalf("at %d: %d pixels differ", at, diff)
+		}
+	}
+}
+
+func decodeEncoded(t *testing.T, g *gif.GIF) *gif.GIF {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	if err := gif.EncodeAll(buf, g); err != nil {
+		t.Fatalf("encoding: %v", err)
+	}
+
+	out, err := gif.DecodeAll(buf)
+	if err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+
+	return out
+}
+
+// checkLossless runs the optimizer on the encoded g, both on its own and
+// through smallestEncoding, and compares the playback with the source.
+func checkLossless(t *testing.T, g *gif.GIF) {
+	t.Helper()
+
+	source := decodeEncoded(t, g)
+
+	if optimized := optimizeGif(source, 0); optimized != nil {
+		samePlayback(t, source, decodeEncoded(t, optimized))
+	}
+
+	baseline := new(bytes.Buffer)
+	if err := gif.EncodeAll(baseline, source); err != nil {
+		t.Fatalf("encoding: %v", err)
+	}
+
+	out, err := smallestEncoding(source, baseline.Bytes(), "test")
+	if err != nil {
+		t.Fatalf("smallestEncoding: %v", err)
+	}
+
+	result, err := gif.DecodeAll(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("decoding result: %v", err)
+	}
+
+	samePlayback(t, source, result)
+}
+
+func TestOptimizeGifKeepsLocalPalettes(t *testing.T) {
+	useDefaultConfig(t)
+
+	g := &gif.GIF{Config: image.Config{Width: 64, Height: 64}}
+
+	for i := range 3 {
+		g.Image = append(g.Image, noise(image.NewPaletted(image.Rect(0, 0, 64, 64), fullPalette(i)), -1))
+		g.Delay = append(g.Delay, 10)
+		g.Disposal = append(g.Disposal, gif.DisposalNone)
+	}
+
+	// A partial frame with its own colors on top of the last one.
+	g.Image = append(g.Image, noise(image.NewPaletted(image.Rect(8, 8, 40, 40), fullPalette(4)), -1))
+	g.Delay = append(g.Delay, 10)
+	g.Disposal = append(g.Disposal, gif.DisposalNone)
+
+	if optimizeGif(decodeEncoded(t, g), 0) == nil {
+		t.Fatal("optimizeGif gave up on frames that fit a palette each")
+	}
+
+	checkLossless(t, g)
+}
+
+func TestOptimizeGifSharedPaletteMergesFrames(t *testing.T) {
+	useDefaultConfig(t)
+
+	palette := color.Palette{color.Black, color.White, color.RGBA{255, 0, 0, 255}}
+	g := &gif.GIF{Config: image.Config{Width: 16, Height: 16}}
+
+	for i := range 4 {
+		img := image.NewPaletted(image.Rect(0, 0, 16, 16), palette)
+		// The second and third frame are the same.
+		img.Pix[min(i, 2)] = 2
+		g.Image = append(g.Image, img)
+		g.Delay = append(g.Delay, 5+i)
+		g.Disposal = append(g.Disposal, gif.DisposalNone)
+	}
+
+	optimized := optimizeGif(decodeEncoded(t, g), 0)
+	if len(optimized.Image) != 3 {
+		t.Fatalf("got %d frames, want the same frames merged into 3", len(optimized.Image))
+	}
+
+	checkLossless(t, g)
+}
+
+func TestOptimizeGifTransparency(t *testing.T) {
+	useDefaultConfig(t)
+
+	palette := color.Palette{color.RGBA{}, color.RGBA{0, 0, 255, 255}, color.RGBA{0, 255, 0, 255}}
+	g := &gif.GIF{Config: image.Config{Width: 16, Height: 16}}
+
+	// A hole that gets filled, then pixels that turn transparent again.
+	first := image.NewPaletted(image.Rect(0, 0, 16, 16), palette)
+	for p := range first.Pix {
+		first.Pix[p] = 1
+	}
+	first.Pix[17] = 0
+
+	second := image.NewPaletted(image.Rect(0, 0, 16, 16), palette)
+	for p := range second.Pix {
+		second.Pix[p] = 2
+	}
+
+	third := image.NewPaletted(image.Rect(0, 0, 16, 16), palette)
+	for p := range third.Pix {
+		third.Pix[p] = uint8(p % 2)
+	}
+
+	g.Image = []*image.Paletted{first, second, third}
+	g.Delay = []int{10, 10, 10}
+	g.Disposal = []byte{gif.DisposalBackground, gif.DisposalBackground, gif.DisposalBackground}
+
+	checkLossless(t, g)
+
+	// The same with more colors than one palette holds.
+	for i, frame := range g.Image {
+		colors := fullPalette(i)
+		colors[0] = color.RGBA{}
+		frame.Palette = colors
+		noise(frame, 0)
+	}
+	g.Image[1].Pix[3] = 0
+
+	checkLossless(t, g)
+}
+
+func TestOptimizeGifDisposal(t *testing.T) {
+	useDefaultConfig(t)
+
+	for _, colors := range []int{4, 256} {
+		palette := fullPalette(0)[:colors]
+		g := &gif.GIF{Config: image.Config{Width: 32, Height: 32}}
+
+		add := func(rect image.Rectangle, disposal byte, seed int) {
+			colors := fullPalette(seed)[:len(palette)]
+			colors[0] = color.RGBA{}
+			img := image.NewPaletted(rect, colors)
+			noise(img, 0)
+			g.Image = append(g.Image, img)
+			g.Delay = append(g.Delay, 10)
+			g.Disposal = append(g.Disposal, disposal)
+		}
+
+		add(image.Rect(0, 0, 32, 32), gif.DisposalNone, 0)
+		add(image.Rect(4, 4, 20, 20), gif.DisposalPrevious, 1)
+		add(image.Rect(10, 10, 30, 30), gif.DisposalBackground, 2)
+		add(image.Rect(0, 0, 8, 8), gif.DisposalNone, 3)
+
+		checkLossless(t, g)
+	}
+}
+
+func TestOptimizeEncodedGifSkipsOverBudget(t *testing.T) {
+	useDefaultConfig(t)
+	AppConfig.Decode.MaxGifFrames = 2
+
+	palette := color.Palette{color.Black, color.White}
+	g := &gif.GIF{Config: image.Config{Width: 8, Height: 8}}
+
+	for i := range 3 {
+		img := image.NewPaletted(image.Rect(0, 0, 8, 8), palette)
+		img.Pix[i] = 1
+		g.Image = append(g.Image, img)
+		g.Delay = append(g.Delay, 10)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gif.EncodeAll(buf, g); err != nil {
+		t.Fatalf("encoding: %v", err)
+	}
+
+	if out := optimizeEncodedGif(buf.Bytes(), "test"); !bytes.Equal(out, buf.Bytes()) {
+		t.Fatal("a GIF over the frame limit was decoded and optimized")
+	}
+}
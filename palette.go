@@ -0,0 +1,393 @@
+package main
+
+import (
+	"cmp"
+	"image"
+	"image/color"
+	"math"
+	"slices"
+)
+
+const (
+	QuantizerPopularity = "popularity"
+	QuantizerMedianCut  = "mediancut"
+	QuantizerOctree     = "octree"
+)
+
+// quantizers are the palette builders users can pick for still images and
+// GIF edits, ffmpeg builds its own palette for videos.
+var quantizers = map[string]func(colors []colorCount, size int) color.Palette{
+	QuantizerPopularity: popularityPalette,
+	QuantizerMedianCut:  medianCutPalette,
+	QuantizerOctree:     octreePalette,
+}
+
+// stillDithers are the ditherModes the Go quantizer implements. Error
+// diffusion kernels are given as x offset, y offset and weight.
+var stillDithers = map[string][]struct {
+	dx, dy int
+	weight float32
+}{
+	"floyd_steinberg": {{1, 0, 7.0 / 16}, {-1, 1, 3.0 / 16}, {0, 1, 5.0 / 16}, {1, 1, 1.0 / 16}},
+	"sierra2_4a":      {{1, 0, 2.0 / 4}, {-1, 1, 1.0 / 4}, {0, 1, 1.0 / 4}},
+	"bayer":           nil,
+	"none":            nil,
+}
+
+// bayerMatrix is the 8x8 ordered dither threshold map.
+var bayerMatrix = [8][8]float32{
+	{0, 32, 8, 40, 2, 34, 10, 42},
+	{48, 16, 56, 24, 50, 18, 58, 26},
+	{12, 44, 4, 36, 14, 46, 6, 38},
+	{60, 28, 52, 20, 62, 30, 54, 22},
+	{3, 35, 11, 43, 1, 33, 9, 41},
+	{51, 19, 59, 27, 49, 17, 57, 25},
+	{15, 47, 7, 39, 13, 45, 5, 37},
+	{63, 31, 55, 23, 61, 29, 53, 21},
+}
+
+// Quantization picks how frames are reduced to a GIF palette.
+type Quantization struct {
+	Quantizer string
+	Dither    string
+	// Colors is the palette size including the transparent entry.
+	Colors int
+}
+
+// exactQuantization keeps every color of frames that already fit in a GIF
+// palette, which is what re-encoding existing GIFs needs.
+var exactQuantization = Quantization{Quantizer: QuantizerPopularity, Dither: "none", Colors: 256}
+
+type colorCount struct {
+	rgb   [3]uint8
+	count int
+}
+
+func rgbColor(rgb [3]uint8) color.Color {
+	return color.RGBA{rgb[0], rgb[1], rgb[2], 0xff}
+}
+
+// popularityPalette keeps the most used colors.
+func popularityPalette(colors []colorCount, size int) color.Palette {
+	sorted := slices.Clone(colors)
+	slices.SortFunc(sorted, func(a, b colorCount) int {
+		return cmp.Compare(b.count, a.count)
+	})
+
+	palette := make(color.Palette, 0, size)
+	for _, c := range sorted[:min(size, len(sorted))] {
+		palette = append(palette, rgbColor(c.rgb))
+	}
+
+	return palette
+}
+
+// medianCutPalette keeps splitting the box of colors with the widest range at
+// the median of its widest channel, each box then becomes its average color.
+func medianCutPalette(colors []colorCount, size int) color.Palette {
+	boxes := [][]colorCount{slices.Clone(colors)}
+
+	widest := func(box []colorCount) (channel int, span int) {
+		for ch := 0; ch < 3; ch++ {
+			lo, hi := 255, 0
+			for _, c := range box {
+				lo = min(lo, int(c.rgb[ch]))
+				hi = max(hi, int(c.rgb[ch]))
+			}
+
+			if hi-lo > span {
+				channel, span = ch, hi-lo
+			}
+		}
+
+		return channel, span
+	}
+
+	for len(boxes) < size {
+		best, bestSpan := -1, 0
+
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+
+			if _, span := widest(box); span > bestSpan {
+				best, bestSpan = i, span
+			}
+		}
+
+		if best < 0 {
+			break
+		}
+
+		box := boxes[best]
+		channel, _ := widest(box)
+
+		slices.SortFunc(box, func(a, b colorCount) int {
+			return cmp.Compare(a.rgb[channel], b.rgb[channel])
+		})
+
+		total := 0
+		for _, c := range box {
+			total += c.count
+		}
+
+		split, seen := 1, 0
+		for i, c := range box[:len(box)-1] {
+			seen += c.count
+			split = i + 1
+
+			if seen*2 >= total {
+				break
+			}
+		}
+
+		boxes[best] = box[:split]
+		boxes = append(boxes, box[split:])
+	}
+
+	palette := make(color.Palette, 0, len(boxes))
+	for _, box := range boxes {
+		palette = append(palette, averageColor(box))
+	}
+
+	return palette
+}
+
+func averageColor(colors []colorCount) color.Color {
+	var sum [3]int
+	total := 0
+
+	for _, c := range colors {
+		for ch := 0; ch < 3; ch++ {
+			sum[ch] += int(c.rgb[ch]) * c.count
+		}
+		total += c.count
+	}
+
+	total = max(total, 1)
+
+	return color.RGBA{uint8(sum[0] / total), uint8(sum[1] / total), uint8(sum[2] / total), 0xff}
+}
+
+type octreeNode struct {
+	children [8]*octreeNode
+	sum      [3]int
+	count    int
+	leaf     bool
+}
+
+// pixels is the number of pixels in the subtree.
+func (n *octreeNode) pixels() int {
+	if n.leaf {
+		return n.count
+	}
+
+	total := 0
+	for _, child := range n.children {
+		if child != nil {
+			total += child.pixels()
+		}
+	}
+
+	return total
+}
+
+// octreePalette sorts colors into an octree by their bits and merges the
+// least used branches, deepest first, until few enough leaves are left.
+func octreePalette(colors []colorCount, size int) color.Palette {
+	root := &octreeNode{}
+	levels := [8][]*octreeNode{{root}}
+	leaves := 0
+
+	for _, c := range colors {
+		node := root
+
+		for level := 0; level < 8; level++ {
+			shift := 7 - level
+			index := int(c.rgb[0]>>shift&1)<<2 | int(c.rgb[1]>>shift&1)<<1 | int(c.rgb[2]>>shift&1)
+
+			if node.children[index] == nil {
+				child := &octreeNode{leaf: level == 7}
+				node.children[index] = child
+
+				if child.leaf {
+					leaves++
+				} else {
+					levels[level+1] = append(levels[level+1], child)
+				}
+			}
+
+			node = node.children[index]
+		}
+
+		for ch := 0; ch < 3; ch++ {
+			node.sum[ch] += int(c.rgb[ch]) * c.count
+		}
+		node.count += c.count
+	}
+
+	for level := 7; level >= 0 && leaves > size; level-- {
+		nodes := levels[level]
+		slices.SortFunc(nodes, func(a, b *octreeNode) int {
+			return cmp.Compare(a.pixels(), b.pixels())
+		})
+
+		for _, node := range nodes {
+			if leaves <= size {
+				break
+			}
+
+			merged := 0
+			for i, child := range node.children {
+				if child == nil {
+					continue
+				}
+
+				for ch := 0; ch < 3; ch++ {
+					node.sum[ch] += child.sum[ch]
+				}
+				node.count += child.count
+				node.children[i] = nil
+				merged++
+			}
+
+			node.leaf = true
+			leaves -= merged - 1
+		}
+	}
+
+	palette := make(color.Palette, 0, size)
+
+	var collect func(node *octreeNode)
+	collect = func(node *octreeNode) {
+		if node.leaf {
+			if node.count > 0 {
+				c := node.count
+				palette = append(palette, color.RGBA{uint8(node.sum[0] / c), uint8(node.sum[1] / c), uint8(node.sum[2] / c), 0xff})
+			}
+			return
+		}
+
+		for _, child := range node.children {
+			if child != nil {
+				collect(child)
+			}
+		}
+	}
+	collect(root)
+
+	return palette
+}
+
+// paletteMapper finds the nearest palette entry, caching colors it has seen.
+type paletteMapper struct {
+	rgb   [][3]int32
+	cache map[uint32]uint8
+}
+
+func newPaletteMapper(palette color.Palette) *paletteMapper {
+	m := &paletteMapper{cache: make(map[uint32]uint8, 1024)}
+
+	for _, c := range palette {
+		r, g, b, _ := c.RGBA()
+		m.rgb = append(m.rgb, [3]int32{int32(r >> 8), int32(g >> 8), int32(b >> 8)})
+	}
+
+	return m
+}
+
+func (m *paletteMapper) index(r, g, b uint8) uint8 {
+	key := uint32(r)<<16 | uint32(g)<<8 | uint32(b)
+	if index, ok := m.cache[key]; ok {
+		return index
+	}
+
+	best, bestDist := 0, int32(math.MaxInt32)
+
+	for i, c := range m.rgb {
+		dr, dg, db := c[0]-int32(r), c[1]-int32(g), c[2]-int32(b)
+		if dist := dr*dr + dg*dg + db*db; dist < bestDist {
+			best, bestDist = i, dist
+		}
+	}
+
+	m.cache[key] = uint8(best)
+
+	return uint8(best)
+}
+
+func clampChannel(v float32) uint8 {
+	return uint8(min(255, max(0, v+0.5)))
+}
+
+// ditherFrame maps the opaque pixels of frame to the palette of the mapper,
+// shifted by offset, and the rest to the transparent index 0.
+func ditherFrame(frame *image.NRGBA, palette color.Palette, mapper *paletteMapper, offset int, alphaThreshold uint8, dither string) *image.Paletted {
+	paletted := image.NewPaletted(frame.Rect, palette)
+	width, height := frame.Rect.Dx(), frame.Rect.Dy()
+
+	kernel := stillDithers[dither]
+	spread := float32(255 / math.Cbrt(float64(max(2, len(mapper.rgb)))))
+
+	// errs holds the diffused error of the current and the next rows.
+	var errs [2][]float32
+	if kernel != nil {
+		errs[0] = make([]float32, (width+2)*3)
+		errs[1] = make([]float32, (width+2)*3)
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := y*frame.Stride + x*4
+			q := y*paletted.Stride + x
+
+			if frame.Pix[p+3] < alphaThreshold {
+				paletted.Pix[q] = 0
+				continue
+			}
+
+			var want [3]float32
+			for ch := 0; ch < 3; ch++ {
+				want[ch] = float32(frame.Pix[p+ch])
+			}
+
+			switch {
+			case dither == "bayer":
+				for ch := range want {
+					want[ch] += (bayerMatrix[y%8][x%8]/64 - 0.5) * spread
+				}
+			case kernel != nil:
+				for ch := range want {
+					want[ch] += errs[0][(x+1)*3+ch]
+				}
+			}
+
+			index := mapper.index(clampChannel(want[0]), clampChannel(want[1]), clampChannel(want[2]))
+			paletted.Pix[q] = index + uint8(offset)
+
+			if kernel == nil {
+				continue
+			}
+
+			got := mapper.rgb[index]
+			for _, k := range kernel {
+				nx := x + k.dx
+				if nx < 0 || nx >= width {
+					continue
+				}
+
+				for ch := range want {
+					errs[k.dy][(nx+1)*3+ch] += (want[ch] - float32(got[ch])) * k.weight
+				}
+			}
+		}
+
+		if kernel != nil {
+			errs[0], errs[1] = errs[1], errs[0]
+			clear(errs[1])
+		}
+	}
+
+	return paletted
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxVideoDimension = 8192
+	maxVideoPixels    = 4096 * 4096
+)
+
+// VideoInfo is what ffprobe tells us about an uploaded video.
+type VideoInfo struct {
+	Duration time.Duration
+	Width    int
+	Height   int
+	FPS      float64
+	// Rotation in degrees from the display matrix, ffmpeg applies it while decoding.
+	Rotation int
+	Codec    string
+	HasVideo bool
+	HasAudio bool
+}
+
+// DisplaySize is the size of the video after rotation has been applied.
+func (v VideoInfo) DisplaySize() (int, int) {
+	if v.Rotation == 90 || v.Rotation == 270 {
+		return v.Height, v.Width
+	}
+
+	return v.Width, v.Height
+}
+
+type ffprobeOutput struct {
+	Streams []struct {
+		CodecType    string            `json:"codec_type"`
+		CodecName    string            `json:"codec_name"`
+		Width        int               `json:"width"`
+		Height       int               `json:"height"`
+		RFrameRate   string            `json:"r_frame_rate"`
+		AvgFrameRate string            `json:"avg_frame_rate"`
+		Duration     string            `json:"duration"`
+		Tags         map[string]string `json:"tags"`
+		SideDataList []struct {
+			Rotation float64 `json:"rotation"`
+		} `json:"side_data_list"`
+		Disposition struct {
+			AttachedPic int `json:"attached_pic"`
+		} `json:"disposition"`
+	} `json:"streams"`
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+}
+
+// parseFrameRate parses ffprobe rates like "30000/1001".
+func parseFrameRate(rate string) float64 {
+	num, den, found := strings.Cut(rate, "/")
+
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+
+	if !found {
+		return n
+	}
+
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+
+	return n / d
+}
+
+func parseSeconds(value string) time.Duration {
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func probeVideo(ctx context.Context, path string) (VideoInfo, error) {
+	args := []string{
+		"-v", "error",
+		"-show_streams",
+		"-show_format",
+		"-of", "json",
+		path,
+	}
+
+	var stdout, stderr bytes.Buffer
+
+	err := runFFmpeg(ctx, ffprobePath(), args, nil, &stdout, &stderr)
+	if errors.Is(err, errConversionTimedOut) {
+		return VideoInfo{}, err
+	}
+	if err != nil {
+		slog.Warn("[FFMPEG] ffprobe failed", "error", err, "stderr", stderr.String())
+		return VideoInfo{}, newUserError("This file doesn't look like a video ffmpeg can read.")
+	}
+
+	var probe ffprobeOutput
+	if err := json.Unmarshal(stdout.Bytes(), &probe); err != nil {
+		return VideoInfo{}, fmt.Errorf("failed to parse ffprobe output: %w", err)
+	}
+
+	info := VideoInfo{
+		Duration: parseSeconds(probe.Format.Duration),
+	}
+
+	for _, stream := range probe.Streams {
+		switch stream.CodecType {
+		case "audio":
+			info.HasAudio = true
+		case "video":
+			// Cover art in audio files shows up as a single frame video stream.
+			if info.HasVideo || stream.Disposition.AttachedPic == 1 {
+				continue
+			}
+
+			info.HasVideo = true
+			info.Codec = stream.CodecName
+			info.Width = stream.Width
+			info.Height = stream.Height
+
+			info.FPS = parseFrameRate(stream.AvgFrameRate)
+			if info.FPS == 0 {
+				info.FPS = parseFrameRate(stream.RFrameRate)
+			}
+
+			if rotate, err := strconv.Atoi(stream.Tags["rotate"]); err == nil {
+				info.Rotation = rotate
+			}
+
+			for _, sideData := range stream.SideDataList {
+				if sideData.Rotation != 0 {
+					info.Rotation = int(sideData.Rotation)
+				}
+			}
+
+			info.Rotation = ((info.Rotation % 360) + 360) % 360
+
+			if info.Duration == 0 {
+				info.Duration = parseSeconds(stream.Duration)
+			}
+		}
+	}
+
+	return info, nil
+}
+
+// check rejects videos we can't or don't want to convert.
+func (v VideoInfo) check() error {
+	if !v.HasVideo {
+		return newUserError("This file has no video stream.")
+	}
+
+	if v.Width < 2 || v.Height < 2 {
+		return newUserError("Couldn't read the resolution of this video.")
+	}
+
+	if v.Width > maxVideoDimension || v.Height > maxVideoDimension || v.Width*v.Height > maxVideoPixels {
+		return newUserError("This video's resolution (%dx%d) is too large.", v.Width, v.Height)
+	}
+
+	if v.Duration <= 0 {
+		return newUserError("Couldn't read the length of this video.")
+	}
+
+	return nil
+}
+
+// adapt lowers the frame rate and width so we never produce more frames or
+// pixels than the source has.
+func (v VideoInfo) adapt(opts VideoOptions) VideoOptions {
+	if v.FPS > 0 {
+		opts.FPS = max(1, min(opts.FPS, int(math.Ceil(v.FPS))))
+	}
+
+	width, _ := v.DisplaySize()
+	opts.Width = min(opts.Width, width)
+
+	return opts
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os/exec"
+	"time"
+)
+
+var errConversionTimedOut = newUserError("The conversion timed out, try a shorter clip or a lower fps or width.")
+
+// runFFmpeg runs ffmpeg or ffprobe at path with the configured resource
+// limits. When ctx ends the whole process group is killed, so nothing ffmpeg
+// started keeps running, and errConversionTimedOut is returned.
+func runFFmpeg(ctx context.Context, path string, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	// Resolved here, so a missing binary fails like it would without the
+	// wrapper that sets the limits.
+	bin, err := exec.LookPath(path)
+	if err != nil {
+		return err
+	}
+
+	name, args := limitedCommand(bin, args, AppConfig.FFmpeg)
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// Don't wait forever on pipes held open by a killed process.
+	cmd.WaitDelay = 5 * time.Second
+
+	setProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	err = cmd.Wait()
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) || ctx.Err() == nil && exceededCPULimit(err, AppConfig.FFmpeg) {
+		slog.Warn("[FFMPEG] Conversion timed out", "command", path, "error", err)
+		ffmpegTimeouts.Inc()
+		return errConversionTimedOut
+	}
+
+	return err
+}
@@ -0,0 +1,62 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// setProcessGroup starts the command in its own process group and makes
+// cancelling it kill the whole group.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// limitedCommand wraps path in a shell that caps the address space and CPU
+// time and then execs it, so the limits apply from ffmpeg's first instruction.
+func limitedCommand(path string, args []string, cfg FFmpegConfig) (string, []string) {
+	var limits []string
+
+	if cfg.MemoryLimitMB > 0 {
+		limits = append(limits, fmt.Sprintf("ulimit -v %d", cfg.MemoryLimitMB*1024))
+	}
+
+	if cfg.CPUSeconds > 0 {
+		// SIGXCPU at the soft limit, SIGKILL if it's ignored. The soft limit
+		// goes first, the hard one can't be lowered below it.
+		limits = append(limits, fmt.Sprintf("ulimit -St %d", cfg.CPUSeconds), fmt.Sprintf("ulimit -Ht %d", cfg.CPUSeconds+5))
+	}
+
+	if len(limits) == 0 {
+		return path, args
+	}
+
+	// A limit only fails to be set when a lower one is in place already.
+	script := strings.Join(limits, " 2>/dev/null; ") + ` 2>/dev/null; exec "$0" "$@"`
+
+	return "/bin/sh", append([]string{"-c", script, path}, args...)
+}
+
+// exceededCPULimit reports whether the process was killed for using up its
+// CPU time: SIGXCPU at the soft limit, or SIGKILL at the hard one. Only call
+// it when the process wasn't cancelled, cancelling kills with SIGKILL too.
+func exceededCPULimit(err error, cfg FFmpegConfig) bool {
+	var exitErr *exec.ExitError
+	if cfg.CPUSeconds == 0 || !errors.As(err, &exitErr) {
+		return false
+	}
+
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return false
+	}
+
+	return status.Signal() == syscall.SIGXCPU || status.Signal() == syscall.SIGKILL
+}
@@ -0,0 +1,53 @@
+//go:build linux
+
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestLimitedCommandSetsLimitsBeforeExec(t *testing.T) {
+	cfg := FFmpegConfig{MemoryLimitMB: 1024, CPUSeconds: 10}
+
+	// The wrapped program prints the limits it starts with.
+	name, args := limitedCommand("/bin/sh", []string{"-c", "ulimit -v; ulimit -St; ulimit -Ht"}, cfg)
+
+	out, err := exec.Command(name, args...).Output()
+	if err != nil {
+		t.Fatalf("running the wrapped command: %v", err)
+	}
+
+	if got, want := strings.Fields(string(out)), []string{"1048576", "10", "15"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("limits are %v, want %v", got, want)
+	}
+
+	if name, args := limitedCommand("/bin/true", []string{"x"}, FFmpegConfig{}); name != "/bin/true" || len(args) != 1 {
+		t.Fatalf("without limits the command was wrapped: %s %v", name, args)
+	}
+}
+
+func TestExceededCPULimit(t *testing.T) {
+	killed := func(signal string) error {
+		return exec.Command("/bin/sh", "-c", "kill -"+signal+" $$").Run()
+	}
+
+	limited := FFmpegConfig{CPUSeconds: 10}
+
+	if !exceededCPULimit(killed("XCPU"), limited) {
+		t.Error("SIGXCPU isn't a CPU limit hit")
+	}
+
+	if !exceededCPULimit(killed("KILL"), limited) {
+		t.Error("SIGKILL with a CPU limit isn't a CPU limit hit")
+	}
+
+	if exceededCPULimit(killed("KILL"), FFmpegConfig{}) {
+		t.Error("SIGKILL without a CPU limit counted as a CPU limit hit")
+	}
+
+	if exceededCPULimit(killed("TERM"), limited) {
+		t.Error("SIGTERM counted as a CPU limit hit")
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import "os/exec"
+
+// setProcessGroup is a no-op, cancelling only kills ffmpeg itself here.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// limitedCommand runs path as is, resource limits are only supported on
+// Linux.
+func limitedCommand(path string, args []string, cfg FFmpegConfig) (string, []string) {
+	return path, args
+}
+
+func exceededCPULimit(err error, cfg FFmpegConfig) bool {
+	return false
+}
@@ -63,15 +63,56 @@ var (
 		Name: "discord_connection_status",
 		Help: "Current Discord connection status (1 = connected, 0 = disconnected)",
 	})
-)
 
-func StartPrometheusHTTPHandler() {
-	addr := "127.0.0.1:2112"
+	conversionCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "conversion_cache_hits_total",
+		Help: "Conversions skipped because the same file was already uploaded",
+	})
 
-	if isRunningInDocker() {
-		addr = ":2112"
-	}
+	fileDeletions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "file_deletions_total",
+		Help: "Files deleted by users, by result (removed, shared, partial, failed)",
+	}, []string{"result"})
+	cdnPurgeFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cdn_purge_failures_total",
+		Help: "CDN cache purges of deleted files that failed",
+	})
+
+	queueWaiting = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "conversion_queue_waiting",
+		Help: "Conversions waiting for a worker, by job kind (image, video, archive)",
+	}, []string{"kind"})
+	queueRunning = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "conversion_queue_running",
+		Help: "Conversions being processed, by job kind (image, video, archive)",
+	}, []string{"kind"})
+
+	downloadFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "download_failures_total",
+		Help: "Failed attachment downloads by reason (host, too_large, status, network)",
+	}, []string{"reason"})
+
+	decodeRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "decode_rejections_total",
+		Help: "Images and GIFs refused before decoding, by reason (invalid, image_pixels, gif_frames, gif_pixels)",
+	}, []string{"reason"})
+
+	ffmpegTimeouts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ffmpeg_timeouts_total",
+		Help: "ffmpeg and ffprobe runs killed for taking too long or using up their CPU time",
+	})
+
+	gifOptimizerInputBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gif_optimizer_input_bytes_total",
+		Help: "Size of GIFs before the optimizer ran, by source (archive, video, edit, slideshow)",
+	}, []string{"source"})
+	gifOptimizerSavedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gif_optimizer_saved_bytes_total",
+		Help: "Bytes saved by the GIF optimizer, by source (archive, video, edit, slideshow)",
+	}, []string{"source"})
+)
 
+func StartPrometheusHTTPHandler(addr string) {
 	http.Handle("/metrics", promhttp.Handler())
 
 	slog.Info("[PROMETHEUS] Starting Prometheus metrics server", "addr", addr)
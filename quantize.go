@@ -0,0 +1,94 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"time"
+)
+
+// transparentColor is always the first palette entry when a frame has
+// transparent pixels, the GIF encoder picks it up as the transparent index.
+var transparentColor = color.RGBA{}
+
+// quantizeWithAlpha builds a GIF from frames with one shared palette, keeping
+// every color when they fit. Pixels with an alpha below alphaThreshold become
+// fully transparent instead of being matched to the nearest (usually black)
+// opaque color.
+func quantizeWithAlpha(frames []image.Image, delay time.Duration, alphaThreshold uint8) *gif.GIF {
+	return quantizeFrames(frames, delay, alphaThreshold, exactQuantization)
+}
+
+// quantizeFrames is quantizeWithAlpha with a choice of quantizer, dithering
+// and palette size.
+func quantizeFrames(frames []image.Image, delay time.Duration, alphaThreshold uint8, q Quantization) *gif.GIF {
+	flattened := make([]*image.NRGBA, len(frames))
+	counts := map[[3]uint8]int{}
+	hasTransparency := false
+
+	for i, frame := range frames {
+		nrgba := image.NewNRGBA(frame.Bounds())
+		draw.Draw(nrgba, nrgba.Rect, frame, frame.Bounds().Min, draw.Src)
+		flattened[i] = nrgba
+
+		// Only visible pixels count, transparent ones shouldn't take up
+		// palette entries.
+		for p := 0; p < len(nrgba.Pix); p += 4 {
+			if nrgba.Pix[p+3] >= alphaThreshold {
+				counts[[3]uint8{nrgba.Pix[p], nrgba.Pix[p+1], nrgba.Pix[p+2]}]++
+			} else {
+				hasTransparency = true
+			}
+		}
+	}
+
+	colors := make([]colorCount, 0, len(counts))
+	for rgb, count := range counts {
+		colors = append(colors, colorCount{rgb: rgb, count: count})
+	}
+
+	size := min(256, q.Colors)
+	if hasTransparency {
+		size--
+	}
+	size = max(1, size)
+
+	dither := q.Dither
+
+	var opaquePalette color.Palette
+	if len(colors) <= size {
+		// Every color fits, there is nothing to dither.
+		opaquePalette = popularityPalette(colors, size)
+		dither = "none"
+	} else {
+		opaquePalette = quantizers[q.Quantizer](colors, size)
+	}
+
+	if len(opaquePalette) == 0 {
+		opaquePalette = color.Palette{color.Black}
+	}
+
+	palette := opaquePalette
+	offset := 0
+
+	if hasTransparency {
+		palette = append(color.Palette{transparentColor}, opaquePalette...)
+		offset = 1
+	}
+
+	g := &gif.GIF{
+		Image: make([]*image.Paletted, len(flattened)),
+		Delay: make([]int, len(flattened)),
+	}
+
+	mapper := newPaletteMapper(opaquePalette)
+
+	for i, frame := range flattened {
+		g.Image[i] = ditherFrame(frame, palette, mapper, offset, alphaThreshold, dither)
+		g.Delay[i] = int(delay / (10 * time.Millisecond))
+		g.Disposal = append(g.Disposal, gif.DisposalBackground)
+	}
+
+	return g
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// maxQueueWait is how long a job may wait for a worker, interaction tokens
+// expire after 15 minutes.
+const maxQueueWait = 12 * time.Minute
+
+const (
+	JobImage   = "image"
+	JobVideo   = "video"
+	JobArchive = "archive"
+)
+
+// jobKind is the queue a file of the sniffed format is converted in. GIFs go
+// through the Go decoder and optimizer, videos through ffmpeg.
+func jobKind(media Media) string {
+	switch {
+	case media.Pipeline == PipelineVideo:
+		return JobVideo
+	case media.Name == MediaGIF.Name:
+		return JobArchive
+	}
+
+	return JobImage
+}
+
+// ticket is a place in a workQueue, ready is closed once a worker slot is
+// assigned to it.
+type ticket struct {
+	userID string
+	ready  chan struct{}
+}
+
+// workQueue limits how many jobs of one kind run at once. Waiting jobs are
+// started round robin between users, so one user queueing many files doesn't
+// hold up everyone else.
+type workQueue struct {
+	kind string
+
+	mu   sync.Mutex
+	free int
+	// users have waiting tickets, the first one gets the next free slot.
+	users   []string
+	waiting map[string][]*ticket
+}
+
+func newWorkQueue(kind string, workers int) *workQueue {
+	return &workQueue{
+		kind:    kind,
+		free:    workers,
+		waiting: map[string][]*ticket{},
+	}
+}
+
+var jobQueues map[string]*workQueue
+
+// SetupQueues creates the work queues with the configured worker counts.
+func SetupQueues(cfg *Config) {
+	jobQueues = map[string]*workQueue{
+		JobImage:   newWorkQueue(JobImage, cfg.Queue.ImageWorkers),
+		JobVideo:   newWorkQueue(JobVideo, cfg.Queue.VideoWorkers),
+		JobArchive: newWorkQueue(JobArchive, cfg.Queue.ArchiveWorkers),
+	}
+}
+
+// Enqueue takes a ticket for userID, which is ready right away when a worker
+// is free and nobody is waiting.
+func (q *workQueue) Enqueue(userID string) *ticket {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	t := &ticket{userID: userID, ready: make(chan struct{})}
+
+	if q.free > 0 && len(q.users) == 0 {
+		q.free--
+		close(t.ready)
+		queueRunning.WithLabelValues(q.kind).Inc()
+		return t
+	}
+
+	if len(q.waiting[userID]) == 0 {
+		q.users = append(q.users, userID)
+	}
+	q.waiting[userID] = append(q.waiting[userID], t)
+	queueWaiting.WithLabelValues(q.kind).Inc()
+
+	return t
+}
+
+// Wait blocks until the ticket is ready. When ctx ends first the ticket is
+// given up and ctx's error is returned.
+func (q *workQueue) Wait(ctx context.Context, t *ticket) error {
+	select {
+	case <-t.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	select {
+	case <-t.ready:
+		// Became ready in the meantime, hand the slot back.
+		q.releaseLocked()
+	default:
+		q.removeLocked(t)
+	}
+
+	return ctx.Err()
+}
+
+// Release frees the slot of a ready ticket for the next job.
+func (q *workQueue) Release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.releaseLocked()
+}
+
+func (q *workQueue) releaseLocked() {
+	queueRunning.WithLabelValues(q.kind).Dec()
+
+	if len(q.users) == 0 {
+		q.free++
+		return
+	}
+
+	user := q.users[0]
+	t := q.waiting[user][0]
+	q.waiting[user] = q.waiting[user][1:]
+
+	q.users = q.users[1:]
+	if len(q.waiting[user]) > 0 {
+		q.users = append(q.users, user)
+	} else {
+		delete(q.waiting, user)
+	}
+
+	queueWaiting.WithLabelValues(q.kind).Dec()
+	queueRunning.WithLabelValues(q.kind).Inc()
+	close(t.ready)
+}
+
+func (q *workQueue) removeLocked(t *ticket) {
+	tickets := q.waiting[t.userID]
+
+	index := slices.Index(tickets, t)
+	if index < 0 {
+		return
+	}
+
+	q.waiting[t.userID] = slices.Delete(tickets, index, index+1)
+	queueWaiting.WithLabelValues(q.kind).Dec()
+
+	if len(q.waiting[t.userID]) == 0 {
+		delete(q.waiting, t.userID)
+		q.users = slices.DeleteFunc(q.users, func(user string) bool { return user == t.userID })
+	}
+}
+
+// Position is the place of a waiting ticket in the queue, 1 being the next
+// to start, and 0 once it is ready.
+func (q *workQueue) Position(t *ticket) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	index := slices.Index(q.waiting[t.userID], t)
+	if index < 0 {
+		return 0
+	}
+
+	// Round robin starts one ticket of every user per round, users ahead of
+	// this one in the rotation also get a turn in the ticket's own round.
+	position := 1
+	ahead := true
+
+	for _, user := range q.users {
+		if user == t.userID {
+			ahead = false
+			position += index
+			continue
+		}
+
+		turns := index
+		if ahead {
+			turns++
+		}
+
+		position += min(len(q.waiting[user]), turns)
+	}
+
+	return position
+}
+
+// queuedJob is the state of one attachment of processAttachments, ticket is
+// nil until it was queued.
+type queuedJob struct {
+	queue  *workQueue
+	ticket *ticket
+	done   bool
+}
+
+// progressMessage describes how far the jobs are, including the queue
+// position of the first job that is still waiting.
+func progressMessage(jobs []queuedJob) string {
+	done, waiting, next := 0, 0, 0
+
+	for _, job := range jobs {
+		switch {
+		case job.done:
+			done++
+		case job.ticket != nil:
+			if position := job.queue.Position(job.ticket); position > 0 {
+				waiting++
+
+				if next == 0 || position < next {
+					next = position
+				}
+			}
+		}
+	}
+
+	if len(jobs) == 1 {
+		if waiting > 0 {
+			return fmt.Sprintf("Waiting in queue, position %d...", next)
+		}
+
+		return "Processing file..."
+	}
+
+	msg := fmt.Sprintf("Processing files... %d/%d done", done, len(jobs))
+
+	if waiting > 0 {
+		msg += fmt.Sprintf(", %d waiting in queue (next at position %d)", waiting, next)
+	}
+
+	return msg
+}
+
+// reportProgress edits the interaction response with status every few
+// seconds while it changes. The returned function stops it and only returns
+// once the last edit is done, so it can't overwrite the final response.
+func reportProgress(s *discordgo.Session, i *discordgo.InteractionCreate, initial string, status func() string) func() {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(3 * time.Second)
+		defer ticker.Stop()
+
+		last := initial
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			if msg := status(); msg != last {
+				last = msg
+				s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+					Content: &msg,
+				})
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func ready(t *ticket) bool {
+	select {
+	case <-t.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestWorkQueueRoundRobin(t *testing.T) {
+	q := newWorkQueue("test", 1)
+
+	running := q.Enqueue("a")
+	if !ready(running) {
+		t.Fatal("the first ticket should start right away")
+	}
+
+	a2 := q.Enqueue("a")
+	a3 := q.Enqueue("a")
+	b1 := q.Enqueue("b")
+	c1 := q.Enqueue("c")
+
+	// Users take turns, so b and c don't wait for all of a's files.
+	order := []*ticket{a2, b1, c1, a3}
+	names := map[*ticket]string{a2: "a2", a3: "a3", b1: "b1", c1: "c1"}
+
+	for i, next := range order {
+		for j, waiting := range order[i:] {
+			if got := q.Position(waiting); got != j+1 {
+				t.Errorf("before release %d: %s is at position %d, want %d", i, names[waiting], got, j+1)
+			}
+		}
+
+		q.Release()
+
+		if !ready(next) {
+			t.Fatalf("release %d started the wrong ticket, want %s", i, names[next])
+		}
+
+		if q.Position(next) != 0 {
+			t.Errorf("%s is ready but still has a position", names[next])
+		}
+
+		for _, waiting := range order[i+1:] {
+			if ready(waiting) {
+				t.Fatalf("release %d started %s too, only one worker is free", i, names[waiting])
+			}
+		}
+	}
+
+	q.Release()
+
+	if q.free != 1 || len(q.users) != 0 || len(q.waiting) != 0 {
+		t.Fatalf("queue not empty after every job finished: free %d, users %v", q.free, q.users)
+	}
+}
+
+func TestWorkQueueWaitCancelled(t *testing.T) {
+	q := newWorkQueue("test", 1)
+
+	q.Enqueue("a")
+	b1 := q.Enqueue("b")
+	c1 := q.Enqueue("c")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := q.Wait(ctx, b1); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Wait = %v, want context.Canceled", err)
+	}
+
+	if q.Position(b1) != 0 || q.Position(c1) != 1 {
+		t.Fatalf("positions are b1 %d and c1 %d, want b1 removed and c1 next", q.Position(b1), q.Position(c1))
+	}
+
+	// The slot goes to c, not to the ticket that gave up.
+	q.Release()
+
+	if ready(b1) || !ready(c1) {
+		t.Fatal("release didn't skip the cancelled ticket")
+	}
+}
+
+func TestWorkQueueWaitCancelledAfterReady(t *testing.T) {
+	q := newWorkQueue("test", 1)
+
+	q.Enqueue("a")
+	b1 := q.Enqueue("b")
+
+	// b1 gets the slot while its context has ended already.
+	q.Release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Either Wait sees the ticket is ready and the caller owns the slot, or it
+	// sees ctx first and has to hand the slot back. It must not get lost.
+	switch err := q.Wait(ctx, b1); {
+	case err == nil:
+		q.Release()
+	case !errors.Is(err, context.Canceled):
+		t.Fatalf("Wait = %v, want nil or context.Canceled", err)
+	}
+
+	if q.free != 1 {
+		t.Fatalf("%d free workers after every job finished, want 1", q.free)
+	}
+}
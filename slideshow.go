@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"golang.org/x/image/draw"
+)
+
+const (
+	SizingFit       = "fit"
+	SizingFill      = "fill"
+	SizingLetterbox = "letterbox"
+
+	minSlideDelay = 20 * time.Millisecond
+	maxSlideDelay = 10 * time.Second
+)
+
+// SlideshowOptions controls how several images are combined into one GIF.
+type SlideshowOptions struct {
+	Delay time.Duration
+	// Sizing is how images that don't match the canvas are scaled: fit leaves
+	// the borders transparent, letterbox fills them with black and fill crops.
+	Sizing string
+}
+
+func DefaultSlideshowOptions() SlideshowOptions {
+	return SlideshowOptions{
+		Delay:  500 * time.Millisecond,
+		Sizing: SizingFit,
+	}
+}
+
+// parseSlideshowOptions reads the slideshow modal, empty values keep the defaults.
+func parseSlideshowOptions(delay string, sizing string) (SlideshowOptions, error) {
+	opts := DefaultSlideshowOptions()
+
+	if delay = strings.TrimSpace(delay); delay != "" {
+		ms, err := strconv.Atoi(strings.TrimSuffix(delay, "ms"))
+		if err != nil {
+			return opts, fmt.Errorf("delay has to be a number of milliseconds")
+		}
+		opts.Delay = time.Duration(ms) * time.Millisecond
+	}
+
+	if opts.Delay < minSlideDelay || opts.Delay > maxSlideDelay {
+		return opts, fmt.Errorf("delay has to be between %d and %d milliseconds", minSlideDelay.Milliseconds(), maxSlideDelay.Milliseconds())
+	}
+
+	if sizing = strings.ToLower(strings.TrimSpace(sizing)); sizing != "" {
+		opts.Sizing = sizing
+	}
+
+	switch opts.Sizing {
+	case SizingFit, SizingFill, SizingLetterbox:
+	default:
+		return opts, fmt.Errorf("sizing has to be fit, fill or letterbox")
+	}
+
+	return opts, nil
+}
+
+// slideshowCanvas is the size of the first image, scaled down to the
+// configured maximum width.
+func slideshowCanvas(first image.Rectangle, maxWidth int) image.Rectangle {
+	width, height := first.Dx(), first.Dy()
+
+	if width > maxWidth {
+		height = max(1, height*maxWidth/width)
+		width = maxWidth
+	}
+
+	return image.Rect(0, 0, width, height)
+}
+
+// placeImage scales img onto a canvas of the given size.
+func placeImage(img image.Image, canvas image.Rectangle, sizing string) image.Image {
+	dst := image.NewNRGBA(canvas)
+	src := img.Bounds()
+
+	if sizing == SizingLetterbox {
+		draw.Draw(dst, canvas, image.NewUniform(color.Black), image.Point{}, draw.Src)
+	}
+
+	scaleX := float64(canvas.Dx()) / float64(src.Dx())
+	scaleY := float64(canvas.Dy()) / float64(src.Dy())
+
+	scale := min(scaleX, scaleY)
+	if sizing == SizingFill {
+		scale = max(scaleX, scaleY)
+	}
+
+	width := max(1, int(float64(src.Dx())*scale+0.5))
+	height := max(1, int(float64(src.Dy())*scale+0.5))
+
+	x := (canvas.Dx() - width) / 2
+	y := (canvas.Dy() - height) / 2
+
+	draw.CatmullRom.Scale(dst, image.Rect(x, y, x+width, y+height), img, src, draw.Over, nil)
+
+	return dst
+}
+
+// encodeSlideshow combines the images, in order, into one animated GIF with a
+// palette shared by every frame.
+func encodeSlideshow(images []image.Image, opts SlideshowOptions, q Quantization) (*bytes.Buffer, error) {
+	if len(images) == 0 {
+		return nil, fmt.Errorf("no images to combine")
+	}
+
+	canvas := slideshowCanvas(images[0].Bounds(), AppConfig.Conversion.MaxWidth)
+
+	frames := make([]image.Image, len(images))
+	for i, img := range images {
+		frames[i] = placeImage(img, canvas, opts.Sizing)
+	}
+
+	g := quantizeFrames(frames, opts.Delay, uint8(AppConfig.Conversion.AlphaThreshold), q)
+
+	out, err := smallestEncoding(g, nil, "slideshow")
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewBuffer(out), nil
+}
+
+// downloadSlideshow downloads the rest of the images on the message and turns
+// them into a slideshow, first is the already downloaded first image.
+func downloadSlideshow(attachments []*discordgo.MessageAttachment, first []byte, opts SlideshowOptions, q Quantization) (*bytes.Buffer, error) {
+	images := make([]image.Image, 0, len(attachments))
+
+	for i, attachment := range attachments {
+		source := first
+
+		if i > 0 {
+			var err error
+			source, err = downloadAttachment(attachment)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		img, err := decodeImage(source)
+		if err != nil {
+			var uerr *userError
+			if errors.As(err, &uerr) {
+				return nil, newUserError("%s: %s", attachment.Filename, uerr.msg)
+			}
+
+			return nil, newUserError("Couldn't read %s as an image.", attachment.Filename)
+		}
+
+		images = append(images, img)
+	}
+
+	return encodeSlideshow(images, opts, q)
+}
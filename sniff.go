@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+)
+
+const (
+	// PipelineImage formats are decoded into a single image.
+	PipelineImage = "image"
+	// PipelineVideo formats are converted by ffmpeg.
+	PipelineVideo = "video"
+)
+
+// Media is a file format recognized from the first bytes of an upload, the
+// content type Discord reports is only a guess from the file name.
+type Media struct {
+	Name     string
+	Ext      string
+	Pipeline string
+	// FFmpegDecode marks images the Go decoders can't read, ffmpeg converts
+	// them to PNG first.
+	FFmpegDecode bool
+	// Animated is set for formats with more than one frame.
+	Animated bool
+}
+
+var (
+	MediaPNG          = Media{Name: "PNG", Ext: ".png", Pipeline: PipelineImage}
+	MediaJPEG         = Media{Name: "JPEG", Ext: ".jpg", Pipeline: PipelineImage}
+	MediaGIF          = Media{Name: "GIF", Ext: ".gif", Pipeline: PipelineImage}
+	MediaAnimatedGIF  = Media{Name: "GIF", Ext: ".gif", Pipeline: PipelineImage, Animated: true}
+	MediaWebP         = Media{Name: "WebP", Ext: ".webp", Pipeline: PipelineImage}
+	MediaAVIF         = Media{Name: "AVIF", Ext: ".avif", Pipeline: PipelineImage, FFmpegDecode: true}
+	MediaAnimatedAVIF = Media{Name: "AVIF", Ext: ".avif", Pipeline: PipelineVideo, Animated: true}
+	MediaHEIC         = Media{Name: "HEIC", Ext: ".heic", Pipeline: PipelineImage, FFmpegDecode: true}
+	MediaMP4          = Media{Name: "MP4", Ext: ".mp4", Pipeline: PipelineVideo}
+	MediaMOV          = Media{Name: "MOV", Ext: ".mov", Pipeline: PipelineVideo}
+	MediaWebM         = Media{Name: "WebM", Ext: ".webm", Pipeline: PipelineVideo}
+	MediaMKV          = Media{Name: "MKV", Ext: ".mkv", Pipeline: PipelineVideo}
+)
+
+// sniffLength is how much of a file is downloaded to pick its queue, every
+// format can be told apart by its first few bytes.
+const sniffLength = 4096
+
+const acceptedFormats = "PNG, JPEG, GIF, WebP, AVIF, HEIC, MP4, WebM, MOV and MKV"
+
+// heifBrands are the ISO base media brands of HEIC/HEIF images.
+var heifBrands = map[string]bool{
+	"heic": true, "heix": true, "heim": true, "heis": true,
+	"hevc": true, "hevx": true, "hevm": true, "hevs": true,
+	"mif1": true, "msf1": true,
+}
+
+// sniffMedia recognizes the format of data from its magic bytes. Anything
+// else is refused with a message listing the accepted formats.
+func sniffMedia(data []byte) (Media, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return MediaPNG, nil
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return MediaJPEG, nil
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		// Broken GIFs are left for the decoder to refuse.
+		if frames, _, err := scanGif(data); err == nil && frames > 1 {
+			return MediaAnimatedGIF, nil
+		}
+		return MediaGIF, nil
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return MediaWebP, nil
+	case bytes.HasPrefix(data, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		// The EBML header names the document type near the start.
+		if bytes.Contains(data[:min(len(data), 64)], []byte("webm")) {
+			return MediaWebM, nil
+		}
+		return MediaMKV, nil
+	case len(data) >= 12 && string(data[4:8]) == "ftyp":
+		return sniffISOMedia(data), nil
+	case len(data) >= 8 && (string(data[4:8]) == "moov" || string(data[4:8]) == "mdat" || string(data[4:8]) == "wide"):
+		// Old QuickTime files start without an ftyp box.
+		return MediaMOV, nil
+	}
+
+	detected, _, _ := strings.Cut(http.DetectContentType(data), ";")
+
+	return Media{}, newUserError("Unsupported format: %s. Accepted formats are %s.", detected, acceptedFormats)
+}
+
+// sniffISOMedia tells the formats based on the ISO base media file format
+// apart by their major and compatible brands.
+func sniffISOMedia(data []byte) Media {
+	size := int(data[0])<<24 | int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+	size = max(12, min(size, len(data)))
+
+	brands := []string{string(data[8:12])}
+	for i := 16; i+4 <= size; i += 4 {
+		brands = append(brands, string(data[i:i+4]))
+	}
+
+	switch major := brands[0]; {
+	case major == "avis":
+		return MediaAnimatedAVIF
+	case major == "avif":
+		return MediaAVIF
+	case heifBrands[major]:
+		// mif1 is shared by HEIC and AVIF.
+		for _, brand := range brands[1:] {
+			if brand == "avif" {
+				return MediaAVIF
+			}
+		}
+		return MediaHEIC
+	case major == "qt  ":
+		return MediaMOV
+	}
+
+	return MediaMP4
+}
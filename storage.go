@@ -4,60 +4,45 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"os"
+	"mime"
 	"path"
+	"strings"
+	"sync"
 	"time"
 
 	"net/http"
-
-	"github.com/bwmarrin/discordgo"
 )
 
-type Response struct {
-	Header http.Header
-	Body   []byte
-	Status int
-}
-
-type Object struct {
-	UserID          string `json:"UserId,omitempty"`
-	ContentType     string `json:"ContentType,omitempty"`
-	Path            string `json:"Path,omitempty"`
-	ObjectName      string `json:"ObjectName,omitempty"`
-	ReplicatedZones string `json:"ReplicatedZones,omitempty"`
-	LastChanged     string `json:"LastChanged,omitempty"`
-	StorageZoneName string `json:"StorageZoneName,omitempty"`
-	Checksum        string `json:"Checksum,omitempty"`
-	DateCreated     string `json:"DateCreated,omitempty"`
-	GUID            string `json:"Guid,omitempty"`
-	Length          int    `json:"Length,omitempty"`
-	ServerID        int    `json:"ServerId,omitempty"`
-	StorageZoneID   int    `json:"StorageZoneId,omitempty"`
-	ArrayNumber     int    `json:"ArrayNumber,omitempty"`
-	IsDirectory     bool   `json:"IsDirectory,omitempty"`
+var ErrObjectNotFound = errors.New("object not found")
+
+// ErrMirrorDelete is returned when a file was deleted from the primary backend
+// but is still on a mirror.
+var ErrMirrorDelete = errors.New("file is still on a mirror")
+
+// Storage is a place converted files can be written to. Keys are slash
+// separated paths relative to the root of the backend, eg. "gifs/<hash>.gif".
+type Storage interface {
+	Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// List returns the objects stored directly inside dir.
+	List(ctx context.Context, dir string) ([]ObjectInfo, error)
 }
 
-type PullZoneStats struct {
-	TotalBandwidthUsed        int64              `json:"TotalBandwidthUsed"`
-	TotalOriginTraffic        int64              `json:"TotalOriginTraffic"`
-	AverageOriginResponseTime float64            `json:"AverageOriginResponseTime"`
-	OriginResponseTimeChart   map[string]float64 `json:"OriginResponseTimeChart"`
-	TotalRequestsServed       int64              `json:"TotalRequestsServed"`
-	CacheHitRate              float64            `json:"CacheHitRate"`
-	BandwidthUsedChart        map[string]float64 `json:"BandwidthUsedChart"`
-	BandwidthCachedChart      map[string]float64 `json:"BandwidthCachedChart"`
-	CacheHitRateChart         map[string]float64 `json:"CacheHitRateChart"`
-	RequestsServedChart       map[string]float64 `json:"RequestsServedChart"`
-	PullRequestsPulledChart   map[string]float64 `json:"PullRequestsPulledChart"`
+type PutOptions struct {
+	ContentType string
+	Checksum    string
 }
 
-type BunnyStorageObject struct {
-	ObjectName  string `json:"ObjectName"`
-	Length      int64  `json:"Length"`
-	IsDirectory bool   `json:"IsDirectory"`
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	IsDirectory  bool
 }
 
 type StorageZoneStats struct {
@@ -65,102 +50,250 @@ type StorageZoneStats struct {
 	TotalSize  int64 `json:"total_size"`
 }
 
-func Upload(ctx context.Context, filepath string, filename string, checksum string, body io.Reader, discordData *discordgo.Message) (*Response, error) {
-	StorageZoneName := os.Getenv("BUNNYNET_CDN_STORAGE_NAME")
-	AccessKey := os.Getenv("BUNNYNET_CDN_STORAGE_KEY")
-	Region := os.Getenv("BUNNYNET_CDN_STORAGE_REGION")
+var FileStorage Storage
+
+// MirroredStorage writes to the primary backend and copies every write to the
+// mirrors in the background. Reads only ever go to the primary.
+type MirroredStorage struct {
+	Primary Storage
+	Mirrors []Storage
+
+	mu sync.Mutex
+	// uploads are the mirror uploads still running, by key.
+	uploads map[string]*pendingUpload
+}
+
+type pendingUpload struct {
+	count int
+	done  chan struct{}
+}
+
+// startUpload registers a mirror upload of key, finish has to be called once
+// it's done.
+func (m *MirroredStorage) startUpload(key string) (finish func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.uploads == nil {
+		m.uploads = make(map[string]*pendingUpload)
+	}
+
+	upload := m.uploads[key]
+	if upload == nil {
+		upload = &pendingUpload{done: make(chan struct{})}
+		m.uploads[key] = upload
+	}
+	upload.count++
+
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		upload.count--
+		if upload.count == 0 {
+			delete(m.uploads, key)
+			close(upload.done)
+		}
+	}
+}
+
+// waitUploads waits for the mirror uploads of key, so they don't put the file
+// back after it's deleted.
+func (m *MirroredStorage) waitUploads(ctx context.Context, key string) error {
+	m.mu.Lock()
+	upload := m.uploads[key]
+	m.mu.Unlock()
 
-	baseURL := "storage.bunnycdn.com"
-	if Region != "" {
-		baseURL = Region + "." + baseURL
+	if upload == nil {
+		return nil
 	}
 
-	url := fmt.Sprintf("https://%s%s", baseURL, path.Join("/", StorageZoneName, filepath, filename))
+	select {
+	case <-upload.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
+func (m *MirroredStorage) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error {
 	data, err := io.ReadAll(body)
 	if err != nil {
 		uploadFailures.WithLabelValues("body_read_fail").Inc()
-		return nil, err
+		return err
 	}
 
-	bodyForReq := bytes.NewReader(data)
-	req, err := http.NewRequestWithContext(ctx, "PUT", url, bodyForReq)
-	if err != nil {
-		return nil, err
+	if err := m.Primary.Put(ctx, key, bytes.NewReader(data), opts); err != nil {
+		uploadFailures.WithLabelValues(storageName(m.Primary) + "_upload_fail").Inc()
+		return err
+	}
+
+	for _, mirror := range m.Mirrors {
+		finish := m.startUpload(key)
+
+		go func(mirror Storage) {
+			defer finish()
+
+			if err := mirror.Put(context.Background(), key, bytes.NewReader(data), opts); err != nil {
+				slog.Error("[STORAGE] Failed to upload to mirror", "backend", storageName(mirror), "key", key, "error", err)
+				backupUploadFailures.WithLabelValues(storageName(mirror) + "_failure").Inc()
+				return
+			}
+
+			slog.Info("[STORAGE] Uploaded file to mirror", "backend", storageName(mirror), "key", key)
+		}(mirror)
 	}
 
-	req.Header.Set("AccessKey", AccessKey)
-	req.Header.Set("Content-Type", "application/octet-stream")
-	req.Header.Set("Accept", "application/json")
+	return nil
+}
 
-	if checksum != "" {
-		req.Header.Set("Checksum", checksum)
+// Delete deletes key from every backend. The error wraps ErrMirrorDelete
+// when only mirrors failed, deleting again retries them.
+func (m *MirroredStorage) Delete(ctx context.Context, key string) error {
+	if err := m.waitUploads(ctx, key); err != nil {
+		return err
 	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		slog.Error("Failed updating avatar", "error", err)
-		uploadFailures.WithLabelValues("bcdn_upload_fail").Inc()
-		return nil, err
+	// A file missing from the primary may still be on the mirrors.
+	if err := m.Primary.Delete(ctx, key); err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
+
+	var errs []error
+
+	for _, mirror := range m.Mirrors {
+		if err := mirror.Delete(ctx, key); err != nil && !errors.Is(err, ErrObjectNotFound) {
+			slog.Error("[STORAGE] Failed to delete from mirror", "backend", storageName(mirror), "key", key, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", storageName(mirror), err))
+		}
 	}
-	defer resp.Body.Close()
 
-	responseBody, _ := io.ReadAll(resp.Body)
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %w", ErrMirrorDelete, errors.Join(errs...))
+	}
 
-	go UploadToBackupSite(ctx, filepath, filename, bytes.NewReader(data))
+	return nil
+}
 
-	uploadCounter.Inc()
+func (m *MirroredStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	return m.Primary.Stat(ctx, key)
+}
 
-	return &Response{
-		Status: resp.StatusCode,
-		Body:   responseBody,
-	}, nil
+func (m *MirroredStorage) List(ctx context.Context, dir string) ([]ObjectInfo, error) {
+	return m.Primary.List(ctx, dir)
 }
 
-func Delete(ctx context.Context, filepath string, filename string) (*Response, error) {
-	StorageZoneName := os.Getenv("BUNNYNET_CDN_STORAGE_NAME")
-	AccessKey := os.Getenv("BUNNYNET_CDN_STORAGE_KEY")
-	Region := os.Getenv("BUNNYNET_CDN_STORAGE_REGION")
+func storageName(s Storage) string {
+	switch s.(type) {
+	case *BunnyStorage:
+		return "bunny"
+	case *S3Storage:
+		return "s3"
+	case *LocalStorage:
+		return "local"
+	case *MirroredStorage:
+		return "mirrored"
+	}
+
+	return "unknown"
+}
 
-	baseURL := "storage.bunnycdn.com"
-	if Region != "" {
-		baseURL = Region + "." + baseURL
+func newStorageBackend(name string, cfg *Config) (Storage, error) {
+	switch name {
+	case "bunny":
+		return NewBunnyStorage(cfg.Bunny), nil
+	case "s3":
+		return NewS3Storage(context.Background(), cfg.S3)
+	case "local":
+		return NewLocalStorage(cfg.Local.Dir)
 	}
 
-	url := fmt.Sprintf("https://%s%s", baseURL, path.Join("/", StorageZoneName, filepath, filename))
+	return nil, fmt.Errorf("unknown storage backend %q", name)
+}
 
-	req, err := http.NewRequestWithContext(ctx, "DELETE", url, nil)
+// SetupStorage builds FileStorage from the configured primary backend and its
+// mirrors.
+func SetupStorage(cfg *Config) error {
+	primary, err := newStorageBackend(cfg.Storage.Primary, cfg)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("primary storage: %w", err)
+	}
+
+	if local, ok := primary.(*LocalStorage); ok && cfg.Local.ServeFiles {
+		go StartFileServer(local.Root, cfg.Local.ListenAddr)
+	}
+
+	storage := &MirroredStorage{Primary: primary}
+
+	for _, name := range cfg.Storage.Mirrors {
+		mirror, err := newStorageBackend(name, cfg)
+		if err != nil {
+			return fmt.Errorf("mirror storage: %w", err)
+		}
+
+		storage.Mirrors = append(storage.Mirrors, mirror)
 	}
 
-	req.Header.Set("AccessKey", AccessKey)
-	req.Header.Set("Accept", "application/json")
+	slog.Info("[STORAGE] Storage configured", "primary", cfg.Storage.Primary, "mirrors", cfg.Storage.Mirrors)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	FileStorage = storage
+
+	return nil
+}
+
+func storageKey(filepath string, filename string) string {
+	return strings.TrimPrefix(path.Join("/", filepath, filename), "/")
+}
+
+func publicURL(key string) string {
+	return AppConfig.Storage.PublicURL + "/" + key
+}
+
+func Upload(ctx context.Context, filepath string, filename string, checksum string, body io.Reader) error {
+	err := FileStorage.Put(ctx, storageKey(filepath, filename), body, PutOptions{
+		ContentType: mime.TypeByExtension(path.Ext(filename)),
+		Checksum:    checksum,
+	})
 	if err != nil {
-		return nil, err
+		slog.Error("[STORAGE] Failed uploading file", "file", filename, "error", err)
+		return err
 	}
-	defer resp.Body.Close()
 
-	responseBody, _ := io.ReadAll(resp.Body)
+	uploadCounter.Inc()
+
+	return nil
+}
+
+func Delete(ctx context.Context, filepath string, filename string) error {
+	return FileStorage.Delete(ctx, storageKey(filepath, filename))
+}
 
-	return &Response{
-		Status: resp.StatusCode,
-		Body:   responseBody,
-	}, nil
+type PullZoneStats struct {
+	TotalBandwidthUsed        int64              `json:"TotalBandwidthUsed"`
+	TotalOriginTraffic        int64              `json:"TotalOriginTraffic"`
+	AverageOriginResponseTime float64            `json:"AverageOriginResponseTime"`
+	OriginResponseTimeChart   map[string]float64 `json:"OriginResponseTimeChart"`
+	TotalRequestsServed       int64              `json:"TotalRequestsServed"`
+	CacheHitRate              float64            `json:"CacheHitRate"`
+	BandwidthUsedChart        map[string]float64 `json:"BandwidthUsedChart"`
+	BandwidthCachedChart      map[string]float64 `json:"BandwidthCachedChart"`
+	CacheHitRateChart         map[string]float64 `json:"CacheHitRateChart"`
+	RequestsServedChart       map[string]float64 `json:"RequestsServedChart"`
+	PullRequestsPulledChart   map[string]float64 `json:"PullRequestsPulledChart"`
 }
 
 func GetPullZoneStats() (PullZoneStats, error) {
-	url := "https://api.bunny.net/statistics?pullZone=3680182"
+	if AppConfig.Bunny.PullZoneID == 0 || AppConfig.Bunny.APIKey == "" {
+		return PullZoneStats{}, fmt.Errorf("bunny pull zone statistics are not configured")
+	}
+
+	url := fmt.Sprintf("https://api.bunny.net/statistics?pullZone=%d", AppConfig.Bunny.PullZoneID)
 
 	req, _ := http.NewRequest("GET", url, nil)
 
 	req.Header.Add("accept", "application/json")
 
-	req.Header.Add("AccessKey", os.Getenv("BUNNYNET_API_KEY"))
+	req.Header.Add("AccessKey", AppConfig.Bunny.APIKey)
 
 	client := &http.Client{Timeout: 5 * time.Second}
 	res, err := client.Do(req)
@@ -186,29 +319,12 @@ func GetPullZoneStats() (PullZoneStats, error) {
 }
 
 func GetStorageZoneStats() (StorageZoneStats, error) {
-	url := "https://storage.bunnycdn.com/pngtogif/gifs/"
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return StorageZoneStats{}, fmt.Errorf("creating request failed: %w", err)
-	}
-	req.Header.Set("AccessKey", os.Getenv("BUNNYNET_CDN_STORAGE_KEY"))
-	req.Header.Set("Accept", "application/json")
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	res, err := client.Do(req)
-	if err != nil {
-		return StorageZoneStats{}, fmt.Errorf("request failed: %w", err)
-	}
-	defer res.Body.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-	body, err := io.ReadAll(res.Body)
+	objects, err := FileStorage.List(ctx, "gifs")
 	if err != nil {
-		return StorageZoneStats{}, fmt.Errorf("reading response body failed: %w", err)
-	}
-
-	var objects []BunnyStorageObject
-	if err := json.Unmarshal(body, &objects); err != nil {
-		return StorageZoneStats{}, fmt.Errorf("unmarshaling response failed: %w", err)
+		return StorageZoneStats{}, fmt.Errorf("listing files failed: %w", err)
 	}
 
 	var stats StorageZoneStats
@@ -218,7 +334,7 @@ func GetStorageZoneStats() (StorageZoneStats, error) {
 			continue
 		}
 		stats.TotalFiles++
-		stats.TotalSize += int64(obj.Length)
+		stats.TotalSize += obj.Size
 	}
 
 	return stats, nil
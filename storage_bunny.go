@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Object struct {
+	UserID          string `json:"UserId,omitempty"`
+	ContentType     string `json:"ContentType,omitempty"`
+	Path            string `json:"Path,omitempty"`
+	ObjectName      string `json:"ObjectName,omitempty"`
+	ReplicatedZones string `json:"ReplicatedZones,omitempty"`
+	LastChanged     string `json:"LastChanged,omitempty"`
+	StorageZoneName string `json:"StorageZoneName,omitempty"`
+	Checksum        string `json:"Checksum,omitempty"`
+	DateCreated     string `json:"DateCreated,omitempty"`
+	GUID            string `json:"Guid,omitempty"`
+	Length          int    `json:"Length,omitempty"`
+	ServerID        int    `json:"ServerId,omitempty"`
+	StorageZoneID   int    `json:"StorageZoneId,omitempty"`
+	ArrayNumber     int    `json:"ArrayNumber,omitempty"`
+	IsDirectory     bool   `json:"IsDirectory,omitempty"`
+}
+
+type BunnyStorageObject struct {
+	ObjectName  string `json:"ObjectName"`
+	Length      int64  `json:"Length"`
+	IsDirectory bool   `json:"IsDirectory"`
+	LastChanged string `json:"LastChanged"`
+}
+
+// BunnyStorage talks to the bunny.net Edge Storage API.
+type BunnyStorage struct {
+	ZoneName  string
+	AccessKey string
+	Region    string
+
+	client *http.Client
+}
+
+func NewBunnyStorage(cfg BunnyConfig) *BunnyStorage {
+	return &BunnyStorage{
+		ZoneName:  cfg.StorageZone,
+		AccessKey: cfg.StorageKey,
+		Region:    cfg.StorageRegion,
+		client:    &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+func (b *BunnyStorage) url(key string) string {
+	baseURL := "storage.bunnycdn.com"
+	if b.Region != "" {
+		baseURL = b.Region + "." + baseURL
+	}
+
+	return fmt.Sprintf("https://%s%s", baseURL, path.Join("/", b.ZoneName, key))
+}
+
+func (b *BunnyStorage) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("AccessKey", b.AccessKey)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrObjectNotFound
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("bunny storage returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return resp, nil
+}
+
+func (b *BunnyStorage) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error {
+	req, err := http.NewRequestWithContext(ctx, "PUT", b.url(key), body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	if opts.Checksum != "" {
+		req.Header.Set("Checksum", opts.Checksum)
+	}
+
+	resp, err := b.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+func (b *BunnyStorage) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", b.url(key), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// Stat asks for the first byte of the object, the storage API has no
+// dedicated metadata endpoint for single files.
+func (b *BunnyStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", b.url(key), nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	req.Header.Set("Range", "bytes=0-0")
+
+	resp, err := b.do(req)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer resp.Body.Close()
+
+	info := ObjectInfo{Key: key, Size: resp.ContentLength}
+
+	if contentRange := resp.Header.Get("Content-Range"); contentRange != "" {
+		if i := strings.LastIndex(contentRange, "/"); i != -1 {
+			if size, err := strconv.ParseInt(contentRange[i+1:], 10, 64); err == nil {
+				info.Size = size
+			}
+		}
+	}
+
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.LastModified = lastModified
+	}
+
+	return info, nil
+}
+
+func (b *BunnyStorage) List(ctx context.Context, dir string) ([]ObjectInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", b.url(dir)+"/", nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request failed: %w", err)
+	}
+
+	resp, err := b.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var objects []BunnyStorageObject
+	if err := json.NewDecoder(resp.Body).Decode(&objects); err != nil {
+		return nil, fmt.Errorf("unmarshaling response failed: %w", err)
+	}
+
+	infos := make([]ObjectInfo, 0, len(objects))
+
+	for _, obj := range objects {
+		info := ObjectInfo{
+			Key:         path.Join(dir, obj.ObjectName),
+			Size:        obj.Length,
+			IsDirectory: obj.IsDirectory,
+		}
+
+		if lastChanged, err := time.Parse("2006-01-02T15:04:05.999", obj.LastChanged); err == nil {
+			info.LastModified = lastChanged
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// PurgeBunnyCache removes a public URL from the bunny.net CDN cache so deleted
+// files stop being served. It does nothing without an API key.
+func PurgeBunnyCache(ctx context.Context, fileURL string) error {
+	if AppConfig.Bunny.APIKey == "" {
+		return nil
+	}
+
+	query := url.Values{"url": {fileURL}, "async": {"false"}}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://api.bunny.net/purge?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("AccessKey", AppConfig.Bunny.APIKey)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("bunny purge returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3Storage stores files in any S3 compatible bucket.
+type S3Storage struct {
+	Client *s3.Client
+	Bucket string
+}
+
+func NewS3Storage(ctx context.Context, settings S3Config) (*S3Storage, error) {
+	cfg, err := config.LoadDefaultConfig(ctx,
+		config.WithRegion(settings.Region),
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(settings.AccessKeyID, settings.SecretAccessKey, "")),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if settings.Endpoint != "" {
+			o.BaseEndpoint = aws.String(settings.Endpoint)
+		}
+		o.UsePathStyle = settings.UsePathStyle
+	})
+
+	slog.Info("[S3] Client created", "endpoint", settings.Endpoint, "bucket", settings.Bucket)
+
+	return &S3Storage{Client: client, Bucket: settings.Bucket}, nil
+}
+
+func (s *S3Storage) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	}
+
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+
+	result, err := s.Client.PutObject(ctx, input)
+	if err != nil {
+		return err
+	}
+
+	if result.ETag == nil {
+		backupUploadFailures.WithLabelValues("no_etag").Inc()
+	}
+
+	return nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	_, err := s.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+
+	return err
+}
+
+func (s *S3Storage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	result, err := s.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return ObjectInfo{}, ErrObjectNotFound
+		}
+		return ObjectInfo{}, err
+	}
+
+	return ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(result.ContentLength),
+		LastModified: aws.ToTime(result.LastModified),
+	}, nil
+}
+
+func (s *S3Storage) List(ctx context.Context, dir string) ([]ObjectInfo, error) {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+
+	paginator := s3.NewListObjectsV2Paginator(s.Client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.Bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	})
+
+	var infos []ObjectInfo
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range page.CommonPrefixes {
+			infos = append(infos, ObjectInfo{
+				Key:         path.Clean(aws.ToString(p.Prefix)),
+				IsDirectory: true,
+			})
+		}
+
+		for _, obj := range page.Contents {
+			infos = append(infos, ObjectInfo{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+
+	return infos, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMirror keeps objects in memory. Puts wait for release when it's set,
+// and deletes fail with deleteErr.
+type fakeMirror struct {
+	mu        sync.Mutex
+	objects   map[string]bool
+	release   chan struct{}
+	deleteErr error
+}
+
+func (f *fakeMirror) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error {
+	if f.release != nil {
+		<-f.release
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key] = true
+
+	return nil
+}
+
+func (f *fakeMirror) Delete(ctx context.Context, key string) error {
+	if f.deleteErr != nil {
+		return f.deleteErr
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.objects[key] {
+		return ErrObjectNotFound
+	}
+	delete(f.objects, key)
+
+	return nil
+}
+
+func (f *fakeMirror) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	return ObjectInfo{}, ErrObjectNotFound
+}
+
+func (f *fakeMirror) List(ctx context.Context, dir string) ([]ObjectInfo, error) {
+	return nil, nil
+}
+
+func (f *fakeMirror) has(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.objects[key]
+}
+
+func newTestMirrored(t *testing.T, mirror *fakeMirror) *MirroredStorage {
+	t.Helper()
+
+	primary, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalStorage: %v", err)
+	}
+
+	return &MirroredStorage{Primary: primary, Mirrors: []Storage{mirror}}
+}
+
+func TestMirroredDeleteWaitsForUploads(t *testing.T) {
+	mirror := &fakeMirror{objects: map[string]bool{}, release: make(chan struct{})}
+	storage := newTestMirrored(t, mirror)
+	ctx := context.Background()
+
+	if err := storage.Put(ctx, "gifs/a.gif", strings.NewReader("GIF89a"), PutOptions{}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	deleted := make(chan error)
+	go func() { deleted <- storage.Delete(ctx, "gifs/a.gif") }()
+
+	select {
+	case err := <-deleted:
+		t.Fatalf("Delete returned %v before the mirror upload finished", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(mirror.release)
+
+	if err := <-deleted; err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	if mirror.has("gifs/a.gif") {
+		t.Fatal("the mirror upload put the file back after it was deleted")
+	}
+
+	// Without uploads running a cancelled delete doesn't wait at all.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if err := storage.waitUploads(cancelled, "gifs/a.gif"); err != nil {
+		t.Fatalf("waitUploads with nothing running = %v", err)
+	}
+}
+
+func TestMirroredDeleteReportsMirrorFailures(t *testing.T) {
+	failure := errors.New("mirror is down")
+	mirror := &fakeMirror{objects: map[string]bool{}, deleteErr: failure}
+	storage := newTestMirrored(t, mirror)
+	ctx := context.Background()
+
+	if err := storage.Put(ctx, "gifs/b.gif", strings.NewReader("GIF89a"), PutOptions{}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	err := storage.Delete(ctx, "gifs/b.gif")
+	if !errors.Is(err, ErrMirrorDelete) || !errors.Is(err, failure) {
+		t.Fatalf("Delete = %v, want ErrMirrorDelete wrapping the mirror error", err)
+	}
+
+	if _, err := storage.Primary.Stat(ctx, "gifs/b.gif"); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("the primary still has the file: %v", err)
+	}
+
+	// Deleting again only retries the mirror.
+	mirror.deleteErr = nil
+
+	if err := storage.Delete(ctx, "gifs/b.gif"); err != nil {
+		t.Fatalf("second Delete: %v", err)
+	}
+
+	if mirror.has("gifs/b.gif") {
+		t.Fatal("the mirror still has the file")
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// aspectPresets are the aspect ratios users can crop to, as width and height.
+var aspectPresets = map[string][2]int{
+	"1:1":  {1, 1},
+	"4:3":  {4, 3},
+	"3:4":  {3, 4},
+	"16:9": {16, 9},
+	"9:16": {9, 16},
+}
+
+// resampleFilters are the scalers users can pick when resizing.
+var resampleFilters = map[string]draw.Interpolator{
+	"nearest":    draw.NearestNeighbor,
+	"bilinear":   draw.BiLinear,
+	"catmullrom": draw.CatmullRom,
+}
+
+// Transform is a crop, rotation and resize of images and GIF frames. They are
+// applied in that order.
+type Transform struct {
+	// Crop is the area to keep in source pixels, Aspect instead crops the
+	// center to one of the aspectPresets.
+	Crop   image.Rectangle
+	Aspect string
+	Rotate int
+	FlipH  bool
+	FlipV  bool
+	// Width resizes the result keeping the aspect ratio, 0 keeps the size.
+	Width  int
+	Filter string
+}
+
+func DefaultTransform() Transform {
+	return Transform{Filter: "catmullrom"}
+}
+
+func (t Transform) Empty() bool {
+	return t == Transform{Filter: t.Filter}
+}
+
+func (t Transform) Validate(limits ConversionConfig) error {
+	if !t.Crop.Empty() && t.Aspect != "" {
+		return fmt.Errorf("use either crop or aspect, not both")
+	}
+
+	if _, ok := aspectPresets[t.Aspect]; t.Aspect != "" && !ok {
+		return fmt.Errorf("unknown aspect ratio %q", t.Aspect)
+	}
+
+	if t.Rotate != 0 && t.Rotate != 90 && t.Rotate != 180 && t.Rotate != 270 {
+		return fmt.Errorf("rotation has to be 90, 180 or 270 degrees")
+	}
+
+	if t.Width != 0 && (t.Width < 16 || t.Width > limits.MaxWidth) {
+		return fmt.Errorf("width has to be between 16 and %d pixels", limits.MaxWidth)
+	}
+
+	if _, ok := resampleFilters[t.Filter]; !ok {
+		return fmt.Errorf("unknown resize filter %q", t.Filter)
+	}
+
+	return nil
+}
+
+// parseCrop parses a crop in WIDTHxHEIGHT+X+Y form, eg. 200x100+10+20.
+func parseCrop(value string) (image.Rectangle, error) {
+	invalid := fmt.Errorf("crop has to look like WIDTHxHEIGHT+X+Y, eg. 200x100+10+20")
+
+	size, offset, _ := strings.Cut(strings.ReplaceAll(strings.ToLower(value), " ", ""), "+")
+	w, h, ok := strings.Cut(size, "x")
+	if !ok {
+		return image.Rectangle{}, invalid
+	}
+
+	x, y := "0", "0"
+	if offset != "" {
+		x, y, ok = strings.Cut(offset, "+")
+		if !ok {
+			return image.Rectangle{}, invalid
+		}
+	}
+
+	var n [4]int
+	for i, part := range []string{w, h, x, y} {
+		v, err := strconv.Atoi(part)
+		if err != nil || v < 0 {
+			return image.Rectangle{}, invalid
+		}
+		n[i] = v
+	}
+
+	if n[0] == 0 || n[1] == 0 {
+		return image.Rectangle{}, invalid
+	}
+
+	return image.Rect(n[2], n[3], n[2]+n[0], n[3]+n[1]), nil
+}
+
+// cropRect resolves the crop against the bounds of the image.
+func (t Transform) cropRect(bounds image.Rectangle) (image.Rectangle, error) {
+	if t.Aspect != "" {
+		ratio := aspectPresets[t.Aspect]
+		width, height := bounds.Dx(), bounds.Dx()*ratio[1]/ratio[0]
+
+		if height > bounds.Dy() {
+			width, height = bounds.Dy()*ratio[0]/ratio[1], bounds.Dy()
+		}
+
+		x := bounds.Min.X + (bounds.Dx()-width)/2
+		y := bounds.Min.Y + (bounds.Dy()-height)/2
+
+		return image.Rect(x, y, x+max(1, width), y+max(1, height)), nil
+	}
+
+	if t.Crop.Empty() {
+		return bounds, nil
+	}
+
+	crop := t.Crop.Add(bounds.Min).Intersect(bounds)
+	if crop.Empty() {
+		return image.Rectangle{}, newUserError("The crop is outside of the %dx%d image.", bounds.Dx(), bounds.Dy())
+	}
+
+	return crop, nil
+}
+
+// outputSize is the size an image with bounds has after the crop, rotation
+// and resize.
+func (t Transform) outputSize(bounds image.Rectangle) (image.Point, error) {
+	crop, err := t.cropRect(bounds)
+	if err != nil {
+		return image.Point{}, err
+	}
+
+	w, h := crop.Dx(), crop.Dy()
+	if t.Rotate == 90 || t.Rotate == 270 {
+		w, h = h, w
+	}
+
+	if t.Width != 0 && t.Width != w {
+		w, h = t.Width, max(1, h*t.Width/w)
+	}
+
+	return image.Pt(w, h), nil
+}
+
+// CheckSize refuses transforms of images with bounds whose result would take
+// more memory than the decode limits allow, before anything is allocated.
+// frames is how many frames of that size are transformed.
+func (t Transform) CheckSize(bounds image.Rectangle, frames int) error {
+	size, err := t.outputSize(bounds)
+	if err != nil {
+		return err
+	}
+
+	limits := AppConfig.Decode
+	pixels := int64(size.X) * int64(size.Y)
+
+	if pixels > limits.MaxImagePixels {
+		decodeRejections.WithLabelValues("image_pixels").Inc()
+		return newUserError("The result would be %dx%d, at most %d megapixels are supported.", size.X, size.Y, limits.MaxImagePixels/1_000_000)
+	}
+
+	if frames > 1 && int64(frames)*pixels > limits.MaxGifPixels {
+		decodeRejections.WithLabelValues("gif_pixels").Inc()
+		return newUserError("The result would be %d frames of %dx%d, more than %d megapixels in total.", frames, size.X, size.Y, limits.MaxGifPixels/1_000_000)
+	}
+
+	return nil
+}
+
+// Apply returns the transformed image. It errors when the crop doesn't
+// overlap the image or the result is over the decode limits.
+func (t Transform) Apply(img image.Image) (*image.RGBA, error) {
+	if err := t.CheckSize(img.Bounds(), 1); err != nil {
+		return nil, err
+	}
+
+	crop, err := t.cropRect(img.Bounds())
+	if err != nil {
+		return nil, err
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, crop.Dx(), crop.Dy()))
+	draw.Draw(out, out.Rect, img, crop.Min, draw.Src)
+
+	if t.Rotate != 0 || t.FlipH || t.FlipV {
+		out = rotateFlip(out, t.Rotate, t.FlipH, t.FlipV)
+	}
+
+	if t.Width != 0 && t.Width != out.Rect.Dx() {
+		height := max(1, out.Rect.Dy()*t.Width/out.Rect.Dx())
+
+		scaled := image.NewRGBA(image.Rect(0, 0, t.Width, height))
+		resampleFilters[t.Filter].Scale(scaled, scaled.Rect, out, out.Rect, draw.Src, nil)
+		out = scaled
+	}
+
+	return out, nil
+}
+
+// rotateFlip rotates img clockwise by a multiple of 90 degrees and then
+// mirrors it.
+func rotateFlip(img *image.RGBA, rotate int, flipH bool, flipV bool) *image.RGBA {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+
+	outW, outH := w, h
+	if rotate == 90 || rotate == 270 {
+		outW, outH = h, w
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, outW, outH))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var nx, ny int
+
+			switch rotate {
+			case 90:
+				nx, ny = h-1-y, x
+			case 180:
+				nx, ny = w-1-x, h-1-y
+			case 270:
+				nx, ny = y, w-1-x
+			default:
+				nx, ny = x, y
+			}
+
+			if flipH {
+				nx = outW - 1 - nx
+			}
+
+			if flipV {
+				ny = outH - 1 - ny
+			}
+
+			src := img.PixOffset(img.Rect.Min.X+x, img.Rect.Min.Y+y)
+			copy(out.Pix[out.PixOffset(nx, ny):], img.Pix[src:src+4])
+		}
+	}
+
+	return out
+}
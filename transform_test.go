@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"testing"
+)
+
+func TestTransformRefusesHugeOutput(t *testing.T) {
+	useDefaultConfig(t)
+	AppConfig.Decode.MaxImagePixels = 1_000_000
+	AppConfig.Decode.MaxGifPixels = 4_000_000
+
+	var uerr *userError
+
+	// Upscaling a thin strip multiplies its height too.
+	strip := Transform{Width: 1024}
+	if err := strip.CheckSize(image.Rect(0, 0, 16, 2_500_000), 1); !errors.As(err, &uerr) {
+		t.Fatalf("CheckSize of a 16x2500000 strip = %v, want a user error", err)
+	}
+
+	if _, err := strip.Apply(image.NewGray(image.Rect(0, 0, 2, 200))); !errors.As(err, &uerr) {
+		t.Fatalf("Apply upscaling 2x200 to 1024 wide = %v, want a user error", err)
+	}
+
+	// Rotating first makes the strip wide, so the same width shrinks it.
+	rotated := Transform{Rotate: 90, Width: 1024}
+	if err := rotated.CheckSize(image.Rect(0, 0, 16, 2_500_000), 1); err != nil {
+		t.Fatalf("CheckSize of a rotated strip = %v, want nil", err)
+	}
+
+	// Every frame fits on its own, all of them together don't.
+	frames := Transform{Width: 1000}
+	if err := frames.CheckSize(image.Rect(0, 0, 20, 20), 1); err != nil {
+		t.Fatalf("CheckSize of one frame = %v, want nil", err)
+	}
+
+	if err := frames.CheckSize(image.Rect(0, 0, 20, 20), 5); !errors.As(err, &uerr) {
+		t.Fatalf("CheckSize of 5 frames = %v, want a user error", err)
+	}
+
+	if _, err := editGif(testGif(5, 20, 20, false), GifEdit{Transform: frames}, Quantization{}); !errors.As(err, &uerr) {
+		t.Fatalf("editGif upscaling 5 frames = %v, want a user error", err)
+	}
+}
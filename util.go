@@ -24,6 +24,19 @@ func GenerateRandomString(length int) (string, error) {
 	return string(result), nil
 }
 
+// userError is an error whose message can be shown to the user as is.
+type userError struct {
+	msg string
+}
+
+func (e *userError) Error() string {
+	return e.msg
+}
+
+func newUserError(format string, args ...any) error {
+	return &userError{msg: fmt.Sprintf(format, args...)}
+}
+
 func isRunningInDocker() bool {
 	if _, err := os.Stat("/.dockerenv"); err == nil {
 		return true
@@ -31,3 +44,11 @@ func isRunningInDocker() bool {
 
 	return false
 }
+
+func envOr(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+
+	return fallback
+}